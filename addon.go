@@ -0,0 +1,164 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The Supervisor of Home Assistant provides SUPERVISOR_TOKEN to every add-on.
+// SUPERVISOR_API and ADDON_OPTIONS allow to use a local stand-in instead.
+const defaultSupervisorAPI = "http://supervisor"
+const defaultAddonOptions = "/data/options.json"
+
+type supervisorMqtt struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Ssl      bool   `json:"ssl"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type supervisorResponse struct {
+	Result  string         `json:"result"`
+	Message string         `json:"message"`
+	Data    supervisorMqtt `json:"data"`
+}
+
+type addonOption struct {
+	Value  string
+	Source string
+}
+
+func isAddon() bool {
+	return os.Getenv("SUPERVISOR_TOKEN") != ""
+}
+
+func getenvDefault(name string, defaultValue string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// readAddonOptions reads the options of the add-on, those are named like
+// the environment variables. Empty and null values are skipped.
+func readAddonOptions(path string) (map[string]string, error) {
+	options := map[string]string{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return options, fmt.Errorf("cannot read add-on options: %w", err)
+	}
+
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return options, fmt.Errorf("cannot parse add-on options %s: %w", path, err)
+	}
+
+	for name, value := range values {
+		if value == nil || value == "" {
+			continue
+		}
+		options[name] = fmt.Sprint(value)
+	}
+	return options, nil
+}
+
+func fetchSupervisorMqtt(api string, token string) (supervisorMqtt, error) {
+	var r supervisorResponse
+	req, err := http.NewRequest(http.MethodGet, api+"/services/mqtt", nil)
+	if err != nil {
+		return r.Data, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return r.Data, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return r.Data, fmt.Errorf("cannot parse mqtt service: %w", err)
+	}
+
+	if r.Result != "ok" {
+		return r.Data, fmt.Errorf("mqtt service is not available: %s", r.Message)
+	}
+
+	return r.Data, nil
+}
+
+// addonOptions returns the add-on options by option name. If no broker is
+// defined explicitly the MQTT service of the Supervisor will be used.
+func addonOptions(names []string) (map[string]addonOption, error) {
+	options := map[string]addonOption{}
+	if !isAddon() {
+		return options, nil
+	}
+
+	path := getenvDefault("ADDON_OPTIONS", defaultAddonOptions)
+	values, err := readAddonOptions(path)
+	if err != nil {
+		return options, err
+	}
+
+	for _, name := range names {
+		if v, found := values[envName(name)]; found {
+			options[name] = addonOption{Value: v, Source: "add-on option " + envName(name)}
+		}
+	}
+
+	if _, found := options["broker"]; found {
+		return options, nil
+	}
+
+	mqtt, err := fetchSupervisorMqtt(getenvDefault("SUPERVISOR_API", defaultSupervisorAPI), os.Getenv("SUPERVISOR_TOKEN"))
+	if err != nil {
+		log.Warn().Err(err).Msg("Cannot query mqtt service of Supervisor")
+		return options, nil
+	}
+
+	scheme := "tcp"
+	if mqtt.Ssl {
+		scheme = "ssl"
+	}
+
+	const source = "supervisor mqtt service"
+	options["broker"] = addonOption{Value: scheme + "://" + mqtt.Host + ":" + strconv.Itoa(mqtt.Port), Source: source}
+	if _, found := options["user"]; !found && mqtt.Username != "" {
+		options["user"] = addonOption{Value: mqtt.Username, Source: source}
+		options["password"] = addonOption{Value: mqtt.Password, Source: source}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,197 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testToken = "secret"
+
+// newSupervisor returns a stand-in of the Supervisor which answers the
+// MQTT service by the response.
+func newSupervisor(t *testing.T, response supervisorResponse) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/mqtt" || r.Header.Get("Authorization") != "Bearer "+testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(supervisorResponse{Result: "error", Message: "unauthorized"}) //nolint:errcheck
+			return
+		}
+		json.NewEncoder(w).Encode(response) //nolint:errcheck
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// setupAddon provides the environment of an add-on with the options.
+func setupAddon(t *testing.T, api string, options string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "options.json")
+	if err := os.WriteFile(path, []byte(options), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SUPERVISOR_TOKEN", testToken)
+	t.Setenv("SUPERVISOR_API", api)
+	t.Setenv("ADDON_OPTIONS", path)
+}
+
+func TestFetchSupervisorMqtt(t *testing.T) {
+	server := newSupervisor(t, supervisorResponse{
+		Result: "ok",
+		Data:   supervisorMqtt{Host: "core-mosquitto", Port: 1883, Username: "addons", Password: "pw"},
+	})
+
+	mqtt, err := fetchSupervisorMqtt(server.URL, testToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := supervisorMqtt{Host: "core-mosquitto", Port: 1883, Username: "addons", Password: "pw"}
+	if mqtt != expected {
+		t.Errorf("got %+v, expected %+v", mqtt, expected)
+	}
+}
+
+func TestFetchSupervisorMqttError(t *testing.T) {
+	server := newSupervisor(t, supervisorResponse{Result: "error", Message: "service not found"})
+
+	if _, err := fetchSupervisorMqtt(server.URL, testToken); err == nil {
+		t.Error("expected error of result")
+	}
+
+	if _, err := fetchSupervisorMqtt(server.URL, "wrong"); err == nil {
+		t.Error("expected error of invalid token")
+	}
+}
+
+func TestAddonOptions(t *testing.T) {
+	names := []string{"heating", "broker", "user", "password"}
+	tests := []struct {
+		name     string
+		mqtt     supervisorMqtt
+		options  string
+		expected map[string]string
+	}{
+		{
+			name:    "supervisor",
+			mqtt:    supervisorMqtt{Host: "core-mosquitto", Port: 1883, Username: "addons", Password: "pw"},
+			options: `{"HEATING": "192.168.1.3", "BROKER": "", "BROKER_USER": null}`,
+			expected: map[string]string{
+				"heating":  "192.168.1.3",
+				"broker":   "tcp://core-mosquitto:1883",
+				"user":     "addons",
+				"password": "pw",
+			},
+		},
+		{
+			name:    "ssl",
+			mqtt:    supervisorMqtt{Host: "core-mosquitto", Port: 8883, Ssl: true},
+			options: `{"HEATING": "192.168.1.3"}`,
+			expected: map[string]string{
+				"heating": "192.168.1.3",
+				"broker":  "ssl://core-mosquitto:8883",
+			},
+		},
+		{
+			name:    "explicit broker",
+			mqtt:    supervisorMqtt{Host: "core-mosquitto", Port: 1883, Username: "addons", Password: "pw"},
+			options: `{"HEATING": "192.168.1.3", "BROKER": "tcp://192.168.1.2:1883"}`,
+			expected: map[string]string{
+				"heating": "192.168.1.3",
+				"broker":  "tcp://192.168.1.2:1883",
+			},
+		},
+		{
+			name:    "explicit user",
+			mqtt:    supervisorMqtt{Host: "core-mosquitto", Port: 1883, Username: "addons", Password: "pw"},
+			options: `{"HEATING": "192.168.1.3", "BROKER_USER": "me", "BROKER_PSW": "mine"}`,
+			expected: map[string]string{
+				"heating":  "192.168.1.3",
+				"broker":   "tcp://core-mosquitto:1883",
+				"user":     "me",
+				"password": "mine",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newSupervisor(t, supervisorResponse{Result: "ok", Data: test.mqtt})
+			setupAddon(t, server.URL, test.options)
+
+			options, err := addonOptions(names)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			values := map[string]string{}
+			for name, option := range options {
+				values[name] = option.Value
+			}
+
+			if len(values) != len(test.expected) {
+				t.Errorf("got %v, expected %v", values, test.expected)
+			}
+			for name, value := range test.expected {
+				if values[name] != value {
+					t.Errorf("%s: got %q, expected %q", name, values[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestAddonOptionsSupervisorError(t *testing.T) {
+	server := newSupervisor(t, supervisorResponse{Result: "error", Message: "service not found"})
+	setupAddon(t, server.URL, `{"HEATING": "192.168.1.3"}`)
+
+	options, err := addonOptions([]string{"heating", "broker"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, found := options["broker"]; found {
+		t.Errorf("unexpected broker %q", options["broker"].Value)
+	}
+}
+
+func TestAddonOptionsDisabled(t *testing.T) {
+	t.Setenv("SUPERVISOR_TOKEN", "")
+
+	options, err := addonOptions([]string{"heating", "broker"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(options) != 0 {
+		t.Errorf("unexpected options %v", options)
+	}
+}
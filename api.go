@@ -0,0 +1,186 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// timeout of a write request, the write may be delayed by debounce and rate limit
+const apiWriteTimeout = 30 * time.Second
+
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+type jsonSystem struct {
+	Version  string            `json:"version"`
+	Host     string            `json:"host"`
+	Rooms    int               `json:"rooms"`
+	ReadOnly bool              `json:"read_only"`
+	Values   map[string]string `json:"values"`
+}
+
+type jsonRoomUpdate struct {
+	Name              *string  `json:"name"`
+	Mode              *int     `json:"mode"`
+	TargetTemperature *float64 `json:"target_temperature"`
+}
+
+type jsonWriteResult struct {
+	Field   string `json:"field"`
+	Value   string `json:"value"`
+	Success bool   `json:"success"`
+}
+
+type jsonWriteResponse struct {
+	Error    string            `json:"error,omitempty"`
+	ReadOnly bool              `json:"read_only,omitempty"`
+	Writes   []jsonWriteResult `json:"writes"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Error().Err(err).Msg("Cannot write response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...any) {
+	writeJSON(w, status, jsonError{Error: fmt.Sprintf(format, a...)})
+}
+
+func handleRooms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, states.rooms())
+}
+
+func handleRoom(w http.ResponseWriter, r *http.Request) {
+	room, found := states.room(r.PathValue("id"))
+	if !found {
+		writeError(w, http.StatusNotFound, "room %s is unknown", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, room)
+}
+
+func handleSystem(bridge *bridgeCfg) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		system := states.system()
+		writeJSON(w, http.StatusOK, jsonSystem{
+			Version:  version,
+			Host:     system["hw.HostName"],
+			Rooms:    len(states.rooms()),
+			ReadOnly: bridge.ReadOnly.Load(),
+			Values:   system,
+		})
+	}
+}
+
+// handleRoomUpdate queues a write for every provided value and waits for
+// the results, so the writes are debounced, rate limited and validated
+// like writes via MQTT.
+func handleRoomUpdate(bridge *bridgeCfg) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number := r.PathValue("id")
+		room, found := states.room(number)
+		if !found {
+			writeError(w, http.StatusNotFound, "room %s is unknown", number)
+			return
+		}
+
+		var update jsonRoomUpdate
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, "cannot parse body: %s", err)
+			return
+		}
+
+		var events []writeEvent
+		if update.Name != nil {
+			if *update.Name == "" {
+				writeError(w, http.StatusBadRequest, "name must not be empty")
+				return
+			}
+			events = append(events, writeEvent{Name: "name", Value: *update.Name})
+		}
+
+		if update.Mode != nil {
+			if *update.Mode < 0 || *update.Mode > 2 {
+				writeError(w, http.StatusBadRequest, "mode must be 0, 1 or 2, got %d", *update.Mode)
+				return
+			}
+			events = append(events, writeEvent{Name: "OPMode", Value: strconv.Itoa(*update.Mode)})
+		}
+
+		if update.TargetTemperature != nil {
+			temperature := *update.TargetTemperature
+			if temperature < room.MinTemperature || temperature > room.MaxTemperature {
+				writeError(w, http.StatusBadRequest, "target_temperature must be between %g and %g, got %g",
+					room.MinTemperature, room.MaxTemperature, temperature)
+				return
+			}
+			events = append(events, writeEvent{Name: "SollTemp", Value: strconv.FormatFloat(temperature, 'f', -1, 64)})
+		}
+
+		if len(events) == 0 {
+			writeError(w, http.StatusBadRequest, "no value to write")
+			return
+		}
+
+		for i := range events {
+			events[i].Prefix = number
+			events[i].Result = make(chan bool, 1)
+			bridge.WriteChannel <- events[i]
+		}
+
+		response := jsonWriteResponse{ReadOnly: bridge.ReadOnly.Load()}
+		timeout := time.After(apiWriteTimeout)
+		for _, event := range events {
+			result := jsonWriteResult{Field: event.Name, Value: event.Value}
+			select {
+			case result.Success = <-event.Result:
+			case <-timeout:
+			}
+
+			if !result.Success {
+				response.Error = "write failed"
+			}
+			response.Writes = append(response.Writes, result)
+		}
+
+		status := http.StatusOK
+		if response.Error != "" {
+			status = http.StatusBadGateway
+		}
+		writeJSON(w, status, response)
+	}
+}
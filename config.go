@@ -0,0 +1,635 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+type roomCfg struct {
+	Name       string   `yaml:"name"`
+	Exclude    bool     `yaml:"exclude"`
+	MinTemp    *float64 `yaml:"min_temp"`
+	MaxTemp    *float64 `yaml:"max_temp"`
+	TempChange *int     `yaml:"tempchange"`
+	Area       string   `yaml:"area"`
+}
+
+type configFile struct {
+	Rooms   map[string]roomCfg `yaml:"rooms"`
+	Options map[string]string  `yaml:",inline"`
+}
+
+type bridgeOptions struct {
+	Env             bool
+	Config          string
+	CheckConfig     bool
+	Heating         string
+	Topic           string
+	Broker          string
+	Password        string
+	User            string
+	Clean           bool
+	Polling         int
+	TempChange      int
+	Debounce        int
+	RateLimit       int
+	RemoveGrace     int
+	Full            bool
+	Sensor          bool
+	Discovery       string
+	Retain          bool
+	DeviceDiscovery bool
+	Homie           string
+	HomieVersion    int
+	HTTP            string
+	Influx          string
+	InfluxOrg       string
+	InfluxBucket    string
+	InfluxToken     string
+	DNSCache        bool
+	Verbose         bool
+	LogLevel        string
+	LogFormat       string
+	ReadOnly        bool
+	Record          string
+	Replay          string
+	Rooms           map[string]roomCfg
+}
+
+// environment variables which are not just the upper case name of the flag
+var envNames = map[string]string{
+	"user":     "BROKER_USER",
+	"password": "BROKER_PSW",
+}
+
+func envName(name string) string {
+	if env, found := envNames[name]; found {
+		return env
+	}
+	return strings.ToUpper(name)
+}
+
+func newFlagSet(opts *bridgeOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.BoolVar(&opts.Env, "env", false, "Allow environment variables if provided")
+	fs.StringVar(&opts.Config, "config", "", "The path of the YAML config file (optional)")
+	fs.BoolVar(&opts.CheckConfig, "check-config", false, "Validate the configuration and exit")
+	fs.StringVar(&opts.Heating, "heating", "", "The IP/hostname of the Roth EnergyLogic")
+	fs.StringVar(&opts.Topic, "topic", "roth", "The topic name to/from which to publish/subscribe")
+	fs.StringVar(&opts.Broker, "broker", "", "The broker URI. ex: tcp://10.10.1.1:1883")
+	fs.StringVar(&opts.Password, "password", "", "The password (optional)")
+	fs.StringVar(&opts.User, "user", "", "The User (optional)")
+	fs.BoolVar(&opts.Clean, "clean", false, "Set clean Session")
+	fs.IntVar(&opts.Polling, "polling", 300, "Refresh interval in seconds")
+	fs.IntVar(&opts.TempChange, "tempchange", 12, "Temperature change warning in hours")
+	fs.IntVar(&opts.Debounce, "debounce", 1000, "Coalesce writes to the same room value within milliseconds")
+	fs.IntVar(&opts.RateLimit, "ratelimit", 500, "Minimum milliseconds between writes to the EnergyLogic")
+	fs.IntVar(&opts.RemoveGrace, "removegrace", 60, "Remove vanished rooms after minutes")
+	fs.BoolVar(&opts.Full, "full", false, "Provide full information to broker")
+	fs.BoolVar(&opts.Sensor, "sensor", true, "Send additional sensor entity")
+	fs.StringVar(&opts.Discovery, "discovery", "homeassistant", "The topic prefix of auto discovery")
+	fs.BoolVar(&opts.Retain, "retain", true, "Publish auto discovery retained")
+	fs.BoolVar(&opts.DeviceDiscovery, "devicediscovery", false, "Publish a single auto discovery per device")
+	fs.StringVar(&opts.Homie, "homie", "", "The base topic of the Homie convention, e.g. homie (optional)")
+	fs.IntVar(&opts.HomieVersion, "homieversion", 4, "The version of the Homie convention (4 or 5)")
+	fs.StringVar(&opts.HTTP, "http", "", "The listen address of the HTTP server for metrics and API, e.g. :8080 (optional)")
+	fs.StringVar(&opts.Influx, "influx", "", "The URL of InfluxDB, e.g. http://10.10.1.1:8086 or udp://10.10.1.1:8089 (optional)")
+	fs.StringVar(&opts.InfluxOrg, "influxorg", "", "The organization of InfluxDB")
+	fs.StringVar(&opts.InfluxBucket, "influxbucket", "", "The bucket of InfluxDB")
+	fs.StringVar(&opts.InfluxToken, "influxtoken", "", "The API token of InfluxDB")
+	fs.BoolVar(&opts.ReadOnly, "readonly", false, "Validate and log writes to the EnergyLogic without sending them")
+	fs.StringVar(&opts.Record, "record", "", "The file to record every request to the EnergyLogic to (optional)")
+	fs.StringVar(&opts.Replay, "replay", "", "The recorded file to replay instead of requests to the EnergyLogic (optional)")
+	fs.BoolVar(&opts.DNSCache, "dns", true, "Use internal DNS cache")
+	fs.BoolVar(&opts.Verbose, "verbose", false, "Provide verbose log information")
+	fs.StringVar(&opts.LogLevel, "loglevel", "info", "The log level, optional per component, e.g. info,controller=debug,mqtt=warn,scheduler=debug")
+	fs.StringVar(&opts.LogFormat, "logformat", "console", "The log format (console or json)")
+	return fs
+}
+
+func readConfigFile(path string) (configFile, error) {
+	var cfg configFile
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	// unknown keys of a room are an error, unknown top-level keys are
+	// collected by the inline options and rejected by parseOptions
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// lookupEnv returns the value of the environment variable of an option or
+// the content of the file referenced by its _FILE variant. The returned
+// source is empty if neither is defined.
+func lookupEnv(name string) (string, string, error) {
+	env := envName(name)
+	value := os.Getenv(env)
+	path := os.Getenv(env + "_FILE")
+
+	switch {
+	case path != "" && value != "":
+		return "", "env " + env, fmt.Errorf("conflicts with %s_FILE", env)
+	case path != "":
+		value, err := readSecret(path)
+		return value, "env " + env + "_FILE", err
+	case value != "":
+		return value, "env " + env, nil
+	}
+	return "", "", nil
+}
+
+// lookupFile returns the value of an option in the config file or the
+// content of the file referenced by its _file variant. Relative paths
+// are resolved against the directory of the config file.
+func lookupFile(options map[string]string, name string, config string) (string, string, error) {
+	value, found := options[name]
+	path, foundPath := options[name+"_file"]
+	source := "file " + config
+
+	switch {
+	case found && foundPath:
+		return "", source, fmt.Errorf("conflicts with %s_file", name)
+	case foundPath:
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(config), path)
+		}
+		value, err := readSecret(path)
+		return value, source, err
+	case found:
+		return value, source, nil
+	}
+	return "", "", nil
+}
+
+// parseOptions resolves every option by precedence: flag, environment
+// variable (only with -env), add-on option, config file and finally the
+// default value.
+// The returned error joins every invalid or conflicting setting.
+func parseOptions(args []string) (*bridgeOptions, error) {
+	opts := &bridgeOptions{}
+	fs := newFlagSet(opts)
+	_ = fs.Parse(args)
+
+	sources := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag -" + f.Name
+	})
+
+	if opts.Env && sources["config"] == "" {
+		opts.Config = os.Getenv("CONFIG")
+	}
+	file, err := readConfigFile(opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	fileSource := "file " + opts.Config
+
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if configurable(f.Name) {
+			names = append(names, f.Name)
+		}
+	})
+	addon, err := addonOptions(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(file.Options)) {
+		option := strings.TrimSuffix(name, "_file")
+		if fs.Lookup(option) == nil || !configurable(option) {
+			errs = append(errs, fmt.Errorf("%s: unknown option (%s)", name, fileSource))
+		}
+	}
+
+	unparsable := map[string]bool{}
+	set := func(name string, value string, source string, err error) {
+		sources[name] = source
+		if err == nil && fs.Set(name, value) != nil {
+			err = fmt.Errorf("invalid value %q", value)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w (%s)", name, err, source))
+			unparsable[name] = true
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != "" || !configurable(f.Name) {
+			return
+		}
+
+		if opts.Env {
+			if value, source, err := lookupEnv(f.Name); source != "" {
+				set(f.Name, value, source, err)
+				return
+			}
+		}
+
+		if option, found := addon[f.Name]; found {
+			set(f.Name, option.Value, option.Source, nil)
+			return
+		}
+
+		if value, source, err := lookupFile(file.Options, f.Name, opts.Config); source != "" {
+			set(f.Name, value, source, err)
+		}
+	})
+
+	// earlier versions accepted the broker without scheme
+	if opts.Broker != "" && !strings.Contains(opts.Broker, "://") {
+		log.Warn().Str("broker", opts.Broker).Msg("Broker has no scheme | tcp:// is assumed")
+		opts.Broker = "tcp://" + opts.Broker
+	}
+
+	opts.Rooms = file.Rooms
+	if opts.Rooms == nil {
+		opts.Rooms = make(map[string]roomCfg)
+	}
+
+	errs = append(errs, validateOptions(opts, sources, unparsable)...)
+	errs = append(errs, validateRooms(opts.Rooms, fileSource)...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return opts, nil
+}
+
+// parseHTTPOption resolves the option http only by flag, environment
+// variable (only with -env) and config file. Other options are neither
+// resolved nor validated, as the health check does not need them.
+func parseHTTPOption(args []string) (string, error) {
+	opts := &bridgeOptions{}
+	fs := newFlagSet(opts)
+	_ = fs.Parse(args)
+
+	flagged := false
+	fs.Visit(func(f *flag.Flag) {
+		flagged = flagged || f.Name == "http"
+	})
+	if flagged {
+		return opts.HTTP, nil
+	}
+
+	if opts.Env {
+		if value, source, err := lookupEnv("http"); source != "" {
+			return value, err
+		}
+
+		if opts.Config == "" {
+			opts.Config = os.Getenv("CONFIG")
+		}
+	}
+
+	file, err := readConfigFile(opts.Config)
+	if err != nil {
+		return "", err
+	}
+
+	if value, source, err := lookupFile(file.Options, "http", opts.Config); source != "" {
+		return value, err
+	}
+
+	return opts.HTTP, nil
+}
+
+// configurable returns false for options which are only allowed as flag.
+func configurable(name string) bool {
+	return name != "env" && name != "config" && name != "check-config"
+}
+
+func validateOptions(opts *bridgeOptions, sources map[string]string, unparsable map[string]bool) []error {
+	var errs []error
+	invalid := func(name string, format string, a ...any) {
+		if unparsable[name] {
+			return // already reported
+		}
+
+		source := sources[name]
+		if source == "" {
+			source = "default"
+		}
+		errs = append(errs, fmt.Errorf("%s: %s (%s)", name, fmt.Sprintf(format, a...), source))
+	}
+
+	required := func(name string, value string) bool {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s: is not defined (use -%s, %s or config file)", name, name, envName(name)))
+			return false
+		}
+		return true
+	}
+
+	// the EnergyLogic is not requested by a replay
+	if (opts.Replay != "" || required("heating", opts.Heating)) && strings.ContainsAny(opts.Heating, "/?#") {
+		invalid("heating", "must be a hostname or IP with optional port, got %q", opts.Heating)
+	}
+
+	if required("broker", opts.Broker) {
+		if err := validateBroker(opts.Broker); err != nil {
+			invalid("broker", "%s", err)
+		}
+	}
+
+	if required("topic", opts.Topic) &&
+		(strings.ContainsAny(opts.Topic, "+#") || strings.HasPrefix(opts.Topic, "/") || strings.HasSuffix(opts.Topic, "/")) {
+		invalid("topic", "must not contain wildcards or a leading/trailing slash, got %q", opts.Topic)
+	}
+
+	if required("discovery", opts.Discovery) &&
+		(strings.ContainsAny(opts.Discovery, "+#") || strings.HasPrefix(opts.Discovery, "/") || strings.HasSuffix(opts.Discovery, "/")) {
+		invalid("discovery", "must not contain wildcards or a leading/trailing slash, got %q", opts.Discovery)
+	}
+
+	if strings.ContainsAny(opts.Homie, "+#") || strings.HasPrefix(opts.Homie, "/") || strings.HasSuffix(opts.Homie, "/") {
+		invalid("homie", "must not contain wildcards or a leading/trailing slash, got %q", opts.Homie)
+	}
+
+	if opts.HomieVersion != 4 && opts.HomieVersion != 5 {
+		invalid("homieversion", "must be 4 or 5, got %d", opts.HomieVersion)
+	}
+
+	if _, _, err := net.SplitHostPort(opts.HTTP); opts.HTTP != "" && err != nil {
+		invalid("http", "must be a listen address like :8080, got %q", opts.HTTP)
+	}
+
+	if opts.Influx != "" {
+		if err := validateInflux(opts.Influx); err != nil {
+			invalid("influx", "%s", err)
+		} else if !strings.HasPrefix(opts.Influx, "udp://") && opts.InfluxBucket == "" {
+			invalid("influxbucket", "is required by the write API of %q", opts.Influx)
+		}
+	}
+
+	if opts.Record != "" && opts.Replay != "" {
+		invalid("record", "cannot be combined with replay")
+	}
+
+	if opts.Password != "" && opts.User == "" {
+		invalid("password", "is defined without user")
+	}
+
+	if _, _, err := parseLogLevels(opts.LogLevel); err != nil {
+		invalid("loglevel", "%s", err)
+	}
+
+	if opts.LogFormat != "console" && opts.LogFormat != "json" {
+		invalid("logformat", "must be console or json, got %q", opts.LogFormat)
+	}
+
+	if opts.Polling <= 0 {
+		invalid("polling", "must be greater than 0, got %d", opts.Polling)
+	}
+
+	if opts.TempChange <= 0 {
+		invalid("tempchange", "must be greater than 0, got %d", opts.TempChange)
+	}
+
+	if opts.Debounce < 0 {
+		invalid("debounce", "must not be negative, got %d", opts.Debounce)
+	}
+
+	if opts.RateLimit < 0 {
+		invalid("ratelimit", "must not be negative, got %d", opts.RateLimit)
+	}
+
+	if opts.RemoveGrace < 0 {
+		invalid("removegrace", "must not be negative, got %d", opts.RemoveGrace)
+	}
+
+	return errs
+}
+
+func validateBroker(broker string) error {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps", "ws", "wss":
+	default:
+		return fmt.Errorf("scheme %q is not supported", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("host is missing in %q", broker)
+	}
+
+	if u.Port() == "" {
+		return fmt.Errorf("port is missing, e.g. %s://%s:1883", u.Scheme, u.Host)
+	}
+
+	return nil
+}
+
+func validateInflux(influx string) error {
+	u, err := url.Parse(influx)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "udp":
+	default:
+		return fmt.Errorf("scheme must be http, https or udp, got %q", influx)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("host is missing in %q", influx)
+	}
+
+	if u.Scheme == "udp" && u.Port() == "" {
+		return fmt.Errorf("port is missing, e.g. udp://%s:8089", u.Host)
+	}
+
+	return nil
+}
+
+func validateRooms(rooms map[string]roomCfg, source string) []error {
+	var errs []error
+	for _, number := range slices.Sorted(maps.Keys(rooms)) {
+		room := rooms[number]
+		invalid := func(format string, a ...any) {
+			errs = append(errs, fmt.Errorf("rooms.%s: %s (%s)", number, fmt.Sprintf(format, a...), source))
+		}
+
+		if _, err := strconv.ParseUint(strings.TrimPrefix(number, "G"), 10, 16); err != nil || !strings.HasPrefix(number, "G") {
+			invalid("room must be named like G0, G1 and so on")
+		}
+
+		checkLimit := func(name string, value *float64) {
+			if value != nil && (*value < temperatureLimitMin || *value > temperatureLimitMax) {
+				invalid("%s must be between %g and %g °C, got %g", name, temperatureLimitMin, temperatureLimitMax, *value)
+			}
+		}
+		checkLimit("min_temp", room.MinTemp)
+		checkLimit("max_temp", room.MaxTemp)
+
+		if room.MinTemp != nil && room.MaxTemp != nil && *room.MinTemp > *room.MaxTemp {
+			invalid("min_temp %g is greater than max_temp %g", *room.MinTemp, *room.MaxTemp)
+		}
+
+		if room.TempChange != nil && *room.TempChange <= 0 {
+			invalid("tempchange must be greater than 0, got %d", *room.TempChange)
+		}
+	}
+	return errs
+}
+
+// logConfigErrors logs every error joined by parseOptions on its own line.
+func logConfigErrors(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			log.Error().Msg(e.Error())
+		}
+		return
+	}
+	log.Error().Msg(err.Error())
+}
+
+func requestReload(bridge *bridgeCfg) {
+	select {
+	case bridge.ReloadChannel <- true:
+	default: // a reload is already pending
+	}
+}
+
+// restartOptions returns the names of all options which differ from the
+// options at startup and cannot be applied to a running bridge.
+func restartOptions(old *bridgeOptions, opts *bridgeOptions) []string {
+	var changed []string
+	check := func(name string, differ bool) {
+		if differ {
+			changed = append(changed, name)
+		}
+	}
+
+	check("heating", old.Heating != opts.Heating)
+	check("topic", old.Topic != opts.Topic)
+	check("broker", old.Broker != opts.Broker)
+	check("clean", old.Clean != opts.Clean)
+	check("debounce", old.Debounce != opts.Debounce)
+	check("ratelimit", old.RateLimit != opts.RateLimit)
+	check("dns", old.DNSCache != opts.DNSCache)
+	check("discovery", old.Discovery != opts.Discovery)
+	check("devicediscovery", old.DeviceDiscovery != opts.DeviceDiscovery)
+	check("homie", old.Homie != opts.Homie)
+	check("homieversion", old.HomieVersion != opts.HomieVersion)
+	check("http", old.HTTP != opts.HTTP)
+	check("influx", old.Influx != opts.Influx)
+	check("influxorg", old.InfluxOrg != opts.InfluxOrg)
+	check("influxbucket", old.InfluxBucket != opts.InfluxBucket)
+	check("influxtoken", old.InfluxToken != opts.InfluxToken)
+	check("verbose", old.Verbose != opts.Verbose)
+	check("loglevel", old.LogLevel != opts.LogLevel)
+	check("logformat", old.LogFormat != opts.LogFormat)
+	check("record", old.Record != opts.Record)
+	check("replay", old.Replay != opts.Replay)
+	return changed
+}
+
+// reload reads the configuration again and applies every option that can be
+// changed while running. It must be called by the refresh goroutine.
+func reload(bridge *bridgeCfg) {
+	log.Info().Msg("Reload configuration")
+	opts, err := parseOptions(os.Args[1:])
+	if err != nil {
+		logConfigErrors(err)
+		log.Error().Msg("Reload canceled | Configuration is invalid")
+		return
+	}
+
+	if changed := restartOptions(bridge.Options, opts); len(changed) > 0 {
+		log.Error().Strs("options", changed).Msg("Reload ignores changed options | Restart is required")
+	}
+
+	if credentials.set(opts.User, opts.Password) {
+		log.Info().Msg("Broker credentials changed | Used by the next connect")
+	}
+
+	if bridge.Polling != opts.Polling {
+		bridge.Polling = opts.Polling
+		bridge.Ticker.Reset(time.Duration(bridge.Polling) * time.Second)
+	}
+
+	bridge.TempChange = opts.TempChange
+	bridge.RemoveGrace = time.Duration(opts.RemoveGrace) * time.Minute
+	bridge.Sensor = opts.Sensor
+	bridge.RetainDiscovery = opts.Retain
+	bridge.FullInformation = opts.Full
+	if bridge.ReadOnly.Swap(opts.ReadOnly) != opts.ReadOnly {
+		bridge.CleanDiscovery["controller"] = true
+	}
+
+	// subscribe again, so excluded rooms are respected
+	for i := 0; i < bridge.LastNumberOfDevices; i++ {
+		unsubscribeRoom(bridge, fmt.Sprint("G", i))
+	}
+	if bridge.LastNumberOfDevices > 0 {
+		bridge.LastNumberOfDevices = 0
+	}
+
+	bridge.Rooms = opts.Rooms
+	refresh(bridge)
+}
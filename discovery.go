@@ -0,0 +1,591 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+type jsonClimateDiscoveryDevice struct {
+	Identifier    string     `json:"identifiers"`
+	Name          string     `json:"name"`
+	Manufacturer  string     `json:"mf,omitempty"`
+	Model         string     `json:"mdl,omitempty"`
+	SwVersion     string     `json:"sw,omitempty"`
+	ConfigURL     string     `json:"cu,omitempty"`
+	SuggestedArea string     `json:"sa,omitempty"`
+	ViaDevice     string     `json:"via_device,omitempty"`
+	Cns           [][]string `json:"cns,omitempty"`
+}
+
+type jsonDiscoveryOrigin struct {
+	Name      string `json:"name"`
+	SwVersion string `json:"sw"`
+	URL       string `json:"url"`
+}
+
+type jsonClimateAvailability struct {
+	Topic string `json:"topic"`
+	//Avail    string `json:"pl_avail"`
+	//NotAvail string `json:"pl_not_avail"`
+}
+
+type jsonClimateDiscovery struct {
+	Name      *string                    `json:"name"`
+	ModeCmdT  string                     `json:"mode_cmd_t,omitempty"`
+	ModeStatT string                     `json:"mode_stat_t"`
+	Avty      []jsonClimateAvailability  `json:"avty"`
+	AvtyMode  string                     `json:"avty_mode"`
+	TempCmdT  string                     `json:"temp_cmd_t,omitempty"`
+	TempStatT string                     `json:"temp_stat_t"`
+	CurrTempT string                     `json:"curr_temp_t"`
+	TempUnit  string                     `json:"temp_unit"`
+	MinTemp   string                     `json:"min_temp"`
+	MaxTemp   string                     `json:"max_temp"`
+	TempStep  string                     `json:"temp_step"`
+	Modes     []string                   `json:"modes"`
+	Device    jsonClimateDiscoveryDevice `json:"device"`
+	Origin    jsonDiscoveryOrigin        `json:"o"`
+	UniqueID  string                     `json:"unique_id"`
+}
+
+type jsonSensorDiscovery struct {
+	Name              string                     `json:"name"`
+	Avty              []jsonClimateAvailability  `json:"avty"`
+	AvtyMode          string                     `json:"avty_mode"`
+	StateTopic        string                     `json:"stat_t"`
+	UnitOfMeasurement string                     `json:"unit_of_meas,omitempty"`
+	StateClass        string                     `json:"stat_cla,omitempty"`
+	DeviceClass       string                     `json:"dev_cla,omitempty"`
+	EntityCategory    string                     `json:"ent_cat,omitempty"`
+	Icon              string                     `json:"ic,omitempty"`
+	Device            jsonClimateDiscoveryDevice `json:"device"`
+	Origin            jsonDiscoveryOrigin        `json:"o"`
+	UniqueID          string                     `json:"unique_id"`
+}
+
+type jsonConfigDiscovery struct {
+	Name              string                     `json:"name"`
+	Avty              []jsonClimateAvailability  `json:"avty"`
+	AvtyMode          string                     `json:"avty_mode"`
+	CommandTopic      string                     `json:"cmd_t"`
+	StateTopic        string                     `json:"stat_t"`
+	Options           []string                   `json:"ops,omitempty"`
+	Min               float64                    `json:"min,omitempty"`
+	Max               float64                    `json:"max,omitempty"`
+	Step              float64                    `json:"step,omitempty"`
+	Mode              string                     `json:"mode,omitempty"`
+	UnitOfMeasurement string                     `json:"unit_of_meas,omitempty"`
+	DeviceClass       string                     `json:"dev_cla,omitempty"`
+	EntityCategory    string                     `json:"ent_cat"`
+	Device            jsonClimateDiscoveryDevice `json:"device"`
+	Origin            jsonDiscoveryOrigin        `json:"o"`
+	UniqueID          string                     `json:"unique_id"`
+}
+
+type jsonButtonDiscovery struct {
+	Name           string                     `json:"name"`
+	Avty           []jsonClimateAvailability  `json:"avty"`
+	AvtyMode       string                     `json:"avty_mode"`
+	CommandTopic   string                     `json:"cmd_t"`
+	EntityCategory string                     `json:"ent_cat,omitempty"`
+	Icon           string                     `json:"ic,omitempty"`
+	Device         jsonClimateDiscoveryDevice `json:"device"`
+	Origin         jsonDiscoveryOrigin        `json:"o"`
+	UniqueID       string                     `json:"unique_id"`
+}
+
+type jsonDeviceDiscovery struct {
+	Device     jsonClimateDiscoveryDevice `json:"dev"`
+	Origin     jsonDiscoveryOrigin        `json:"o"`
+	Components map[string]map[string]any  `json:"cmps"`
+}
+
+type discoveryEntity struct {
+	Component string
+	ObjectID  string
+	Config    any // nil removes the entity
+}
+
+type bridgeCommand struct {
+	Command        string
+	Name           string
+	Icon           string
+	EntityCategory string
+	Writes         bool
+}
+
+// bridgeCommands are provided as buttons of the controller device.
+var bridgeCommands = []bridgeCommand{
+	{"refresh", "Refresh", "mdi:refresh", "", false},
+	{"republish", "Republish discovery", "mdi:home-assistant", "diagnostic", false},
+	{"synctime", "Sync clock", "mdi:clock-check", "config", true},
+}
+
+type diagnosticField struct {
+	Field string
+	Name  string
+	Icon  string
+}
+
+// diagnosticFields are provided as diagnostic sensors of the controller device
+// if the EnergyLogic provides them.
+var diagnosticFields = []diagnosticField{
+	{"hw.IP", "IP address", "mdi:ip-network"},
+	{"hw.NM", "Netmask", "mdi:ip-network"},
+	{"hw.GW", "Gateway", "mdi:router-network"},
+	{"hw.DNS1", "DNS 1", "mdi:dns"},
+	{"hw.DNS2", "DNS 2", "mdi:dns"},
+	{"hw.Addr", "MAC address", "mdi:network"},
+	{"isMaster", "Master", "mdi:crown"},
+	{"totalNumberOfDevices", "Rooms", "mdi:home-thermometer"},
+	{"numberOfSlaveControllers", "Slave controllers", "mdi:counter"},
+	{"R0.SystemStatus", "System status", "mdi:information"},
+	{"R0.DateTime", "Date and time", "mdi:clock"},
+	{"R0.ErrorCode", "Error code", "mdi:alert-circle"},
+	{"STM-APP", "Firmware", "mdi:chip"},
+	{"STM-BL", "Bootloader", "mdi:chip"},
+	{"STELL-APP", "Actuator firmware", "mdi:chip"},
+	{"STELL-BL", "Actuator bootloader", "mdi:chip"},
+}
+
+var discoveryOrigin = jsonDiscoveryOrigin{
+	Name:      "HeatingMqttBridge",
+	SwVersion: version,
+	URL:       "https://github.com/misery/HeatingMqttBridge",
+}
+
+func temperatureUnit(siUnit string) string {
+	switch siUnit {
+	case "0":
+		return "C"
+	case "1":
+		return "F"
+	}
+	return siUnit
+}
+
+func discoveryTopic(bridge *bridgeCfg, component string, number string) string {
+	return bridge.Discovery + "/" + component + "/" + identifier(bridge) + "/" + number + "/config"
+}
+
+func controllerDevice(bridge *bridgeCfg) jsonClimateDiscoveryDevice {
+	id := identifier(bridge)
+	mac := strings.ReplaceAll(bridge.SystemInformation["hw.Addr"], "-", ":")
+	return jsonClimateDiscoveryDevice{
+		Identifier:   id,
+		Name:         id,
+		Manufacturer: "Roth",
+		Model:        "EnergyLogic",
+		SwVersion:    bridge.SystemInformation["STM-APP"],
+		ConfigURL:    "http://" + bridge.HeatingURL,
+		Cns:          [][]string{{"mac", mac}},
+	}
+}
+
+// roomDevice returns a device for every room which is connected
+// via the controller, so rooms can be assigned to different areas.
+func roomDevice(bridge *bridgeCfg, number string, name string) jsonClimateDiscoveryDevice {
+	id := identifier(bridge)
+	return jsonClimateDiscoveryDevice{
+		Identifier:    id + "-" + number,
+		Name:          name,
+		Manufacturer:  "Roth",
+		SuggestedArea: bridge.Rooms[number].Area,
+		ViaDevice:     id,
+	}
+}
+
+// publishDiscovery publishes the config of an entity. Nothing is published
+// without the identifier of the EnergyLogic, as it is part of the topic.
+func publishDiscovery(bridge *bridgeCfg, component string, objectID string, config any) {
+	if identifier(bridge) == "" {
+		return
+	}
+
+	valueJSON, err := json.Marshal(config)
+	if err != nil {
+		log.Error().Err(err).Str("component", component).Msg("Cannot marshal discovery")
+		return
+	}
+
+	publish(bridge, discoveryTopic(bridge, component, objectID), string(valueJSON), bridge.RetainDiscovery)
+}
+
+// clearDiscovery removes the config of an entity by an empty retained message.
+func clearDiscovery(bridge *bridgeCfg, component string, objectID string) {
+	if identifier(bridge) == "" {
+		return
+	}
+
+	publish(bridge, discoveryTopic(bridge, component, objectID), "", true)
+}
+
+// deviceComponent converts the discovery config of an entity to a component
+// of a device discovery, those do not contain device and origin.
+func deviceComponent(component string, config any) (map[string]any, error) {
+	valueJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmp map[string]any
+	if err := json.Unmarshal(valueJSON, &cmp); err != nil {
+		return nil, err
+	}
+
+	delete(cmp, "device")
+	delete(cmp, "o")
+	cmp["p"] = component
+	return cmp, nil
+}
+
+// publishEntities publishes the discovery of every entity of a device.
+// With device discovery all entities are combined into a single config.
+// The configs of the other discovery mode are removed by the first call.
+func publishEntities(bridge *bridgeCfg, objectID string, device jsonClimateDiscoveryDevice, entities []discoveryEntity) {
+	if bridge.CleanDiscovery[objectID] {
+		delete(bridge.CleanDiscovery, objectID)
+		if bridge.DeviceDiscovery {
+			for _, entity := range entities {
+				clearDiscovery(bridge, entity.Component, entity.ObjectID)
+			}
+		} else {
+			clearDiscovery(bridge, "device", objectID)
+		}
+	}
+
+	if !bridge.DeviceDiscovery {
+		for _, entity := range entities {
+			if entity.Config == nil {
+				clearDiscovery(bridge, entity.Component, entity.ObjectID)
+			} else {
+				publishDiscovery(bridge, entity.Component, entity.ObjectID, entity.Config)
+			}
+		}
+		return
+	}
+
+	jsonDiscovery := jsonDeviceDiscovery{
+		Device:     device,
+		Origin:     discoveryOrigin,
+		Components: map[string]map[string]any{},
+	}
+
+	for _, entity := range entities {
+		if entity.Config == nil {
+			// a component with the platform only is removed
+			jsonDiscovery.Components[entity.Component+"_"+entity.ObjectID] = map[string]any{"p": entity.Component}
+			continue
+		}
+
+		cmp, err := deviceComponent(entity.Component, entity.Config)
+		if err != nil {
+			log.Error().Err(err).Str("component", entity.Component).Msg("Cannot marshal discovery")
+			return
+		}
+		jsonDiscovery.Components[entity.Component+"_"+entity.ObjectID] = cmp
+	}
+
+	publishDiscovery(bridge, "device", objectID, jsonDiscovery)
+}
+
+// readOnlyEntity converts a config entity to a diagnostic sensor.
+func readOnlyEntity(entity discoveryEntity) discoveryEntity {
+	config := entity.Config.(jsonConfigDiscovery)
+	jsonDiscoverySensor := jsonSensorDiscovery{
+		Name:              config.Name,
+		Avty:              config.Avty,
+		AvtyMode:          config.AvtyMode,
+		UniqueID:          config.UniqueID,
+		Device:            config.Device,
+		Origin:            config.Origin,
+		StateTopic:        config.StateTopic,
+		UnitOfMeasurement: config.UnitOfMeasurement,
+		DeviceClass:       config.DeviceClass,
+		EntityCategory:    "diagnostic",
+	}
+
+	return discoveryEntity{"sensor", entity.ObjectID, jsonDiscoverySensor}
+}
+
+// removeDiscovery removes every entity of a room by an empty retained config.
+func removeDiscovery(bridge *bridgeCfg, number string) {
+	clearDiscovery(bridge, "device", number)
+	clearDiscovery(bridge, "climate", number)
+	clearDiscovery(bridge, "sensor", number)
+	clearDiscovery(bridge, "binary_sensor", number)
+	clearDiscovery(bridge, "sensor", number+"_lastchange")
+	clearDiscovery(bridge, "text", number+"_name")
+	clearDiscovery(bridge, "select", number+"_unit")
+	clearDiscovery(bridge, "number", number+"_min")
+	clearDiscovery(bridge, "number", number+"_max")
+	clearDiscovery(bridge, "button", number+"_refresh")
+	for _, objectID := range []string{"_name", "_unit", "_min", "_max"} {
+		clearDiscovery(bridge, "sensor", number+objectID)
+	}
+}
+
+func publishJSON(bridge *bridgeCfg, number string, name string, siUnit string,
+	sollTempMin string, sollTempMax string) {
+	id := identifier(bridge)
+	prefix := bridge.Topic + "/" + number
+	siUnit = temperatureUnit(siUnit)
+
+	jsonDiscoveryDevice := roomDevice(bridge, number, name)
+
+	jsonAvailability := []jsonClimateAvailability{
+		{
+			Topic: prefix + "/available",
+			//Avail:    "online",
+			//NotAvail: "offline",
+		},
+		{
+			Topic: bridge.Topic + "/available",
+			//Avail:    "online",
+			//NotAvail: "offline",
+		}}
+
+	// has_entity_name: the climate entity is named like its device
+	jsonDiscoveryClimate := jsonClimateDiscovery{
+		Name:      nil,
+		Avty:      jsonAvailability,
+		AvtyMode:  "all",
+		UniqueID:  id + "-" + number,
+		Device:    jsonDiscoveryDevice,
+		Origin:    discoveryOrigin,
+		ModeCmdT:  prefix + "/set/OPMode",
+		ModeStatT: prefix + "/OPMode_mode",
+		TempCmdT:  prefix + "/set/SollTemp",
+		TempStatT: prefix + "/SollTemp",
+		CurrTempT: prefix + "/RaumTemp",
+		TempUnit:  siUnit,
+		MinTemp:   sollTempMin,
+		MaxTemp:   sollTempMax,
+		TempStep:  "0.5",
+		Modes:     []string{"off", "heat"},
+	}
+	if bridge.ReadOnly.Load() {
+		jsonDiscoveryClimate.ModeCmdT = ""
+		jsonDiscoveryClimate.TempCmdT = ""
+	}
+	entities := []discoveryEntity{{"climate", number, jsonDiscoveryClimate}}
+
+	if bridge.Sensor {
+		jsonDiscoverySensor := jsonSensorDiscovery{
+			Name:              "Temperature",
+			Avty:              jsonAvailability,
+			AvtyMode:          "all",
+			UniqueID:          id + "-sensor-" + number,
+			Device:            jsonDiscoveryDevice,
+			Origin:            discoveryOrigin,
+			StateTopic:        prefix + "/RaumTemp",
+			UnitOfMeasurement: "°" + siUnit,
+			StateClass:        "measurement",
+			DeviceClass:       "temperature",
+		}
+		entities = append(entities, discoveryEntity{"sensor", number, jsonDiscoverySensor})
+	} else if bridge.CleanDiscovery[number] {
+		entities = append(entities, discoveryEntity{"sensor", number, nil})
+	}
+
+	// Both stay available if the room is flagged, as they explain why.
+	bridgeAvailability := []jsonClimateAvailability{{Topic: bridge.Topic + "/available"}}
+	jsonDiscoveryBattery := jsonSensorDiscovery{
+		Name:           "Battery",
+		Avty:           bridgeAvailability,
+		AvtyMode:       "all",
+		UniqueID:       id + "-battery-" + number,
+		Device:         jsonDiscoveryDevice,
+		Origin:         discoveryOrigin,
+		StateTopic:     prefix + "/battery",
+		DeviceClass:    "battery",
+		EntityCategory: "diagnostic",
+	}
+	entities = append(entities, discoveryEntity{"binary_sensor", number, jsonDiscoveryBattery})
+
+	jsonDiscoveryLastChange := jsonSensorDiscovery{
+		Name:           "Last temperature change",
+		Avty:           bridgeAvailability,
+		AvtyMode:       "all",
+		UniqueID:       id + "-lastchange-" + number,
+		Device:         jsonDiscoveryDevice,
+		Origin:         discoveryOrigin,
+		StateTopic:     prefix + "/RaumTempLastChange",
+		DeviceClass:    "timestamp",
+		EntityCategory: "diagnostic",
+	}
+	entities = append(entities, discoveryEntity{"sensor", number + "_lastchange", jsonDiscoveryLastChange})
+
+	jsonDiscoveryName := jsonConfigDiscovery{
+		Name:           "Name",
+		Avty:           bridgeAvailability,
+		AvtyMode:       "all",
+		UniqueID:       id + "-name-" + number,
+		Device:         jsonDiscoveryDevice,
+		Origin:         discoveryOrigin,
+		CommandTopic:   prefix + "/set/name",
+		StateTopic:     prefix + "/name",
+		EntityCategory: "config",
+	}
+	entities = append(entities, discoveryEntity{"text", number + "_name", jsonDiscoveryName})
+
+	jsonDiscoveryUnit := jsonConfigDiscovery{
+		Name:           "Temperature unit",
+		Avty:           bridgeAvailability,
+		AvtyMode:       "all",
+		UniqueID:       id + "-unit-" + number,
+		Device:         jsonDiscoveryDevice,
+		Origin:         discoveryOrigin,
+		CommandTopic:   prefix + "/set/TempSIUnit",
+		StateTopic:     prefix + "/TempSIUnit_unit",
+		Options:        []string{"C", "F"},
+		EntityCategory: "config",
+	}
+	entities = append(entities, discoveryEntity{"select", number + "_unit", jsonDiscoveryUnit})
+
+	limits := []struct {
+		ObjectID string
+		Name     string
+		Field    string
+	}{
+		{"min", "Minimum temperature", "SollTempMinVal"},
+		{"max", "Maximum temperature", "SollTempMaxVal"},
+	}
+	jsonDiscoveryRefresh := jsonButtonDiscovery{
+		Name:         "Refresh",
+		Avty:         bridgeAvailability,
+		AvtyMode:     "all",
+		UniqueID:     id + "-refresh-" + number,
+		Device:       jsonDiscoveryDevice,
+		Origin:       discoveryOrigin,
+		CommandTopic: prefix + "/refresh",
+		Icon:         "mdi:refresh",
+	}
+	entities = append(entities, discoveryEntity{"button", number + "_refresh", jsonDiscoveryRefresh})
+
+	limitMin, limitMax := temperatureLimits(siUnit)
+	for _, limit := range limits {
+		jsonDiscoveryLimit := jsonConfigDiscovery{
+			Name:              limit.Name,
+			Avty:              bridgeAvailability,
+			AvtyMode:          "all",
+			UniqueID:          id + "-" + limit.ObjectID + "-" + number,
+			Device:            jsonDiscoveryDevice,
+			Origin:            discoveryOrigin,
+			CommandTopic:      prefix + "/set/" + limit.Field,
+			StateTopic:        prefix + "/" + limit.Field,
+			Min:               limitMin,
+			Max:               limitMax,
+			Step:              0.5,
+			Mode:              "box",
+			UnitOfMeasurement: "°" + siUnit,
+			DeviceClass:       "temperature",
+			EntityCategory:    "config",
+		}
+		entities = append(entities, discoveryEntity{"number", number + "_" + limit.ObjectID, jsonDiscoveryLimit})
+	}
+
+	// entities of the other mode are removed once
+	var removed []discoveryEntity
+	for i, entity := range entities {
+		if _, writable := entity.Config.(jsonConfigDiscovery); !writable {
+			continue
+		}
+
+		if bridge.ReadOnly.Load() {
+			removed = append(removed, discoveryEntity{entity.Component, entity.ObjectID, nil})
+			entities[i] = readOnlyEntity(entity)
+		} else {
+			removed = append(removed, discoveryEntity{"sensor", entity.ObjectID, nil})
+		}
+	}
+
+	if bridge.CleanDiscovery[number] {
+		entities = append(entities, removed...)
+	}
+
+	publishEntities(bridge, number, jsonDiscoveryDevice, entities)
+}
+
+// publishControllerDiscovery publishes the diagnostic entities and the
+// buttons of the bridge commands for the controller device.
+func publishControllerDiscovery(bridge *bridgeCfg) {
+	id := identifier(bridge)
+	if id == "" {
+		return // system information is missing
+	}
+
+	device := controllerDevice(bridge)
+	availability := []jsonClimateAvailability{{Topic: bridge.Topic + "/available"}}
+
+	var entities []discoveryEntity
+	for _, diagnostic := range diagnosticFields {
+		if _, found := bridge.SystemInformation[diagnostic.Field]; !found {
+			continue
+		}
+
+		objectID := strings.ReplaceAll(diagnostic.Field, ".", "_")
+		jsonDiscoverySensor := jsonSensorDiscovery{
+			Name:           diagnostic.Name,
+			Avty:           availability,
+			AvtyMode:       "all",
+			UniqueID:       id + "-" + objectID,
+			Device:         device,
+			Origin:         discoveryOrigin,
+			StateTopic:     bridge.Topic + "/" + strings.ReplaceAll(diagnostic.Field, ".", "/"),
+			EntityCategory: "diagnostic",
+			Icon:           diagnostic.Icon,
+		}
+
+		entities = append(entities, discoveryEntity{"sensor", objectID, jsonDiscoverySensor})
+	}
+
+	for _, command := range bridgeCommands {
+		if command.Writes && bridge.ReadOnly.Load() {
+			if bridge.CleanDiscovery["controller"] {
+				entities = append(entities, discoveryEntity{"button", command.Command, nil})
+			}
+			continue
+		}
+
+		jsonDiscoveryButton := jsonButtonDiscovery{
+			Name:           command.Name,
+			Avty:           availability,
+			AvtyMode:       "all",
+			UniqueID:       id + "-" + command.Command,
+			Device:         device,
+			Origin:         discoveryOrigin,
+			CommandTopic:   bridge.Topic + "/bridge/" + command.Command,
+			EntityCategory: command.EntityCategory,
+			Icon:           command.Icon,
+		}
+		entities = append(entities, discoveryEntity{"button", command.Command, jsonDiscoveryButton})
+	}
+
+	publishEntities(bridge, "controller", device, entities)
+}
@@ -2,12 +2,13 @@ module github.com/misery/HeatingMqttBridge
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/ncruces/go-dns v1.3.3
 	github.com/rs/zerolog v1.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.21 // indirect
 	golang.org/x/net v0.55.0 // indirect
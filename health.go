@@ -0,0 +1,182 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type bridgeHealth struct {
+	mutex           sync.Mutex
+	LastPoll        time.Time
+	MaxPollAge      time.Duration
+	ControllerError error
+}
+
+var health = &bridgeHealth{}
+
+type jsonHealth struct {
+	Status             string     `json:"status"`
+	Mqtt               bool       `json:"mqtt"`
+	Controller         bool       `json:"controller"`
+	ControllerError    string     `json:"controller_error,omitempty"`
+	LastPoll           *time.Time `json:"last_poll"`
+	LastPollAgeSeconds *int       `json:"last_poll_age_seconds"`
+	stuck              bool
+}
+
+// fetched records whether the EnergyLogic was reachable by the last fetch.
+func (h *bridgeHealth) fetched(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.ControllerError = err
+}
+
+// polled records a successful poll. The polling is stuck if the next one
+// is missing for twice the polling interval.
+func (h *bridgeHealth) polled(polling int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.LastPoll = time.Now()
+	h.MaxPollAge = 2*time.Duration(polling)*time.Second + time.Minute
+}
+
+func (h *bridgeHealth) report(bridge *bridgeCfg) jsonHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	report := jsonHealth{
+		Mqtt:       bridge.Client.IsConnectionOpen(),
+		Controller: h.ControllerError == nil && !h.LastPoll.IsZero(),
+	}
+
+	if h.ControllerError != nil {
+		report.ControllerError = h.ControllerError.Error()
+	}
+
+	if !h.LastPoll.IsZero() {
+		lastPoll := h.LastPoll
+		age := int(time.Since(lastPoll).Seconds())
+		report.LastPoll = &lastPoll
+		report.LastPollAgeSeconds = &age
+		report.stuck = time.Since(lastPoll) > h.MaxPollAge
+	}
+
+	return report
+}
+
+// handleHealth reports whether the bridge is alive, that is the polling
+// is not stuck. It is still alive if the EnergyLogic or broker is gone.
+func handleHealth(bridge *bridgeCfg) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := health.report(bridge)
+		report.Status = "ok"
+		status := http.StatusOK
+		if report.stuck {
+			report.Status = "poll is stuck"
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
+
+// handleReady reports whether the bridge is connected to the broker and
+// polls the EnergyLogic successfully.
+func handleReady(bridge *bridgeCfg) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := health.report(bridge)
+		report.Status = "ok"
+		switch {
+		case !report.Mqtt:
+			report.Status = "broker is not connected"
+		case !report.Controller:
+			report.Status = "controller is not reachable"
+		case report.stuck:
+			report.Status = "poll is stuck"
+		}
+
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	}
+}
+
+// localAddress returns an address to connect to the listen address.
+func localAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// healthcheck queries /readyz of the running bridge and returns the exit
+// code, so it can be used as HEALTHCHECK without any other tool. It is
+// skipped if the HTTP server is disabled.
+func healthcheck(args []string) int {
+	listen, err := parseHTTPOption(args)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid configuration")
+		return 1
+	}
+
+	if listen == "" {
+		log.Warn().Msg("Health check skipped | HTTP server is disabled")
+		return 0
+	}
+
+	address, err := localAddress(listen)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid HTTP address")
+		return 1
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/readyz", address))
+	if err != nil {
+		log.Error().Err(err).Msg("Health check failed")
+		return 1
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Str("status", resp.Status).Msg("Health check failed")
+		return 1
+	}
+
+	log.Info().Msg("Health check passed")
+	return 0
+}
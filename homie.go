@@ -0,0 +1,379 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The Homie convention (https://homieiot.github.io/) describes the EnergyLogic
+// as a device with one node per room. It uses its own connection, because the
+// last will of that connection sets the $state of the device to lost.
+
+type homieProperty struct {
+	ID       string
+	Name     string
+	Field    string
+	Datatype string
+	Settable bool
+}
+
+// homieProperties are provided by every room node. Only fields of
+// roomSetFields are settable.
+var homieProperties = []homieProperty{
+	{"temperature", "Temperature", "RaumTemp", "float", false},
+	{"setpoint", "Target temperature", "SollTemp", "float", true},
+	{"mode", "Mode", "OPMode", "enum", true},
+	{"name", "Name", "name", "string", true},
+}
+
+// homieModes are the values of the OPMode by index.
+var homieModes = []string{"day", "night", "holiday"}
+
+type homieNode struct {
+	Name    string
+	Unit    string
+	MinTemp string
+	MaxTemp string
+}
+
+type jsonHomieProperty struct {
+	Name     string `json:"name"`
+	Datatype string `json:"datatype"`
+	Format   string `json:"format,omitempty"`
+	Unit     string `json:"unit,omitempty"`
+	Settable bool   `json:"settable,omitempty"`
+}
+
+type jsonHomieNode struct {
+	Name       string                       `json:"name"`
+	Type       string                       `json:"type"`
+	Properties map[string]jsonHomieProperty `json:"properties"`
+}
+
+type jsonHomieDescription struct {
+	Homie   string                   `json:"homie"`
+	Version uint32                   `json:"version"`
+	Name    string                   `json:"name"`
+	Nodes   map[string]jsonHomieNode `json:"nodes"`
+}
+
+// homieID returns a valid Homie ID of the name, like "roth" or "g0".
+func homieID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+}
+
+func homieBaseTopic(opts *bridgeOptions) string {
+	if opts.HomieVersion == 5 {
+		return opts.Homie + "/5/" + homieID(opts.Topic)
+	}
+	return opts.Homie + "/" + homieID(opts.Topic)
+}
+
+func createHomieClient(opts *bridgeOptions) MQTT.Client {
+	if opts.Homie == "" {
+		return nil
+	}
+
+	clientOpts := createClientOptions(opts.Broker, opts.Clean, opts.Topic)
+	clientOpts.SetClientID("HeatingMqttBridge-homie")
+	clientOpts.SetOnConnectHandler(homieConnectHandler)
+	clientOpts.SetWill(homieBaseTopic(opts)+"/$state", "lost", 1, true)
+	return MQTT.NewClient(clientOpts)
+}
+
+func homieConnectHandler(client MQTT.Client) {
+	mqttLog.Debug().Msg("Connected Homie")
+	client.Subscribe(bridge.HomieTopic+"/+/+/set", 0, func(client MQTT.Client, msg MQTT.Message) {
+		homieSet(bridge, msg.Topic(), string(msg.Payload()))
+	})
+
+	// publish again if connection was lost, the will has changed the $state
+	bridge.HomieMutex.Lock()
+	published := bridge.HomieDescription != ""
+	bridge.HomieDescription = ""
+	bridge.HomieMutex.Unlock()
+
+	if published {
+		bridge.RefreshRoomChannel <- ""
+	}
+}
+
+func publishHomie(bridge *bridgeCfg, topic string, value string) {
+	token := bridge.HomieClient.Publish(bridge.HomieTopic+"/"+topic, 1, true, value)
+	token.Wait()
+	if token.Error() != nil {
+		mqttLog.Error().Err(token.Error()).Str("value", value).Str("topic", topic).Msg("Cannot publish Homie value")
+	}
+}
+
+// homieSet converts a set message of a property to a write of a room value.
+func homieSet(bridge *bridgeCfg, topic string, value string) {
+	splitted := strings.Split(strings.TrimPrefix(topic, bridge.HomieTopic+"/"), "/")
+	if len(splitted) != 3 || !strings.HasPrefix(splitted[0], "g") {
+		return
+	}
+
+	prefix := "G" + strings.TrimPrefix(splitted[0], "g")
+	bridge.HomieMutex.Lock()
+	_, found := bridge.HomieNodes[prefix]
+	bridge.HomieMutex.Unlock()
+	if !found {
+		log.Error().Str("topic", topic).Msg("Homie node is unknown")
+		return
+	}
+
+	index := slices.IndexFunc(homieProperties, func(p homieProperty) bool { return p.ID == splitted[1] })
+	if index == -1 || !homieProperties[index].Settable {
+		log.Error().Str("topic", topic).Msg("Homie property is not settable")
+		return
+	}
+
+	property := homieProperties[index]
+	if property.ID == "mode" {
+		mode := slices.Index(homieModes, value)
+		if mode == -1 {
+			log.Error().Str("value", value).Msg("Homie mode is unknown")
+			return
+		}
+		value = strconv.Itoa(mode)
+	}
+
+	bridge.WriteChannel <- writeEvent{
+		Prefix: prefix,
+		Name:   property.Field,
+		Value:  value,
+	}
+}
+
+func homieFormat(bridge *bridgeCfg, property homieProperty, node homieNode) string {
+	switch property.ID {
+	case "setpoint":
+		minTemp, _ := strconv.ParseFloat(node.MinTemp, 64)
+		maxTemp, _ := strconv.ParseFloat(node.MaxTemp, 64)
+		format := strconv.FormatFloat(minTemp, 'f', -1, 64) + ":" + strconv.FormatFloat(maxTemp, 'f', -1, 64)
+		if bridge.HomieVersion == 5 {
+			return format + ":0.5"
+		}
+		return format
+	case "mode":
+		return strings.Join(homieModes, ",")
+	}
+	return ""
+}
+
+func homieUnit(property homieProperty, node homieNode) string {
+	if property.Datatype == "float" {
+		return "°" + node.Unit
+	}
+	return ""
+}
+
+func homieDescription(bridge *bridgeCfg) jsonHomieDescription {
+	description := jsonHomieDescription{
+		Homie: "5.0",
+		Name:  identifier(bridge),
+		Nodes: map[string]jsonHomieNode{},
+	}
+
+	for number, node := range bridge.HomieNodes {
+		properties := map[string]jsonHomieProperty{}
+		for _, property := range homieProperties {
+			properties[property.ID] = jsonHomieProperty{
+				Name:     property.Name,
+				Datatype: property.Datatype,
+				Format:   homieFormat(bridge, property, node),
+				Unit:     homieUnit(property, node),
+				Settable: property.Settable && !bridge.ReadOnly.Load(),
+			}
+		}
+		description.Nodes[homieID(number)] = jsonHomieNode{Name: node.Name, Type: "room", Properties: properties}
+	}
+
+	// the version needs to change with any change of the description
+	data, _ := json.Marshal(description)
+	hash := fnv.New32a()
+	hash.Write(data) //nolint:errcheck
+	description.Version = hash.Sum32()
+	return description
+}
+
+// publishHomieDevice publishes the description of the device if it has
+// been changed since the last call. The $state is init while doing so.
+// Nothing is published until every room has been refreshed once.
+func publishHomieDevice(bridge *bridgeCfg) {
+	bridge.HomieMutex.Lock()
+	defer bridge.HomieMutex.Unlock()
+
+	for i := 0; i < bridge.LastNumberOfDevices; i++ {
+		number := fmt.Sprint("G", i)
+		if _, found := bridge.HomieNodes[number]; !found && !bridge.Rooms[number].Exclude {
+			return
+		}
+	}
+
+	description := homieDescription(bridge)
+	data, err := json.Marshal(description)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot marshal Homie description")
+		return
+	}
+
+	if string(data) == bridge.HomieDescription {
+		return
+	}
+
+	log.Debug().Msg("Publish Homie device")
+	publishHomie(bridge, "$state", "init")
+	if bridge.HomieVersion == 5 {
+		publishHomie(bridge, "$description", string(data))
+	} else {
+		numbers := slices.Sorted(maps.Keys(bridge.HomieNodes))
+		nodes := make([]string, 0, len(numbers))
+		for _, number := range numbers {
+			nodes = append(nodes, homieID(number))
+		}
+
+		publishHomie(bridge, "$homie", "4.0")
+		publishHomie(bridge, "$name", description.Name)
+		publishHomie(bridge, "$nodes", strings.Join(nodes, ","))
+		publishHomie(bridge, "$extensions", "")
+		publishHomie(bridge, "$implementation", "HeatingMqttBridge "+version)
+
+		for id, node := range description.Nodes {
+			ids := make([]string, 0, len(homieProperties))
+			for _, property := range homieProperties {
+				ids = append(ids, property.ID)
+			}
+
+			publishHomie(bridge, id+"/$name", node.Name)
+			publishHomie(bridge, id+"/$type", node.Type)
+			publishHomie(bridge, id+"/$properties", strings.Join(ids, ","))
+			for propertyID, property := range node.Properties {
+				prefix := id + "/" + propertyID + "/"
+				publishHomie(bridge, prefix+"$name", property.Name)
+				publishHomie(bridge, prefix+"$datatype", property.Datatype)
+				publishHomie(bridge, prefix+"$format", property.Format)
+				publishHomie(bridge, prefix+"$unit", property.Unit)
+				publishHomie(bridge, prefix+"$settable", strconv.FormatBool(property.Settable))
+			}
+		}
+	}
+	publishHomie(bridge, "$state", "ready")
+	bridge.HomieDescription = string(data)
+}
+
+// publishHomieRoom publishes the node of a room and its property values.
+func publishHomieRoom(bridge *bridgeCfg, number string, node homieNode, values map[string]string) {
+	if bridge.HomieClient == nil {
+		return
+	}
+
+	bridge.HomieMutex.Lock()
+	bridge.HomieNodes[number] = node
+	bridge.HomieMutex.Unlock()
+	publishHomieDevice(bridge)
+
+	for _, property := range homieProperties {
+		value := values[property.Field]
+		if property.ID == "mode" {
+			if mode, err := strconv.Atoi(value); err == nil && mode >= 0 && mode < len(homieModes) {
+				value = homieModes[mode]
+			}
+		}
+		publishHomie(bridge, homieID(number)+"/"+property.ID, value)
+	}
+}
+
+// removeHomieRooms removes the nodes of vanished and excluded rooms.
+func removeHomieRooms(bridge *bridgeCfg, totalNumberOfDevices int) {
+	if bridge.HomieClient == nil {
+		return
+	}
+
+	var removed []string
+	bridge.HomieMutex.Lock()
+	for number := range bridge.HomieNodes {
+		index, _ := strconv.Atoi(strings.TrimPrefix(number, "G"))
+		if index < totalNumberOfDevices && !bridge.Rooms[number].Exclude {
+			continue
+		}
+
+		delete(bridge.HomieNodes, number)
+		removed = append(removed, number)
+	}
+	bridge.HomieMutex.Unlock()
+
+	if len(removed) == 0 {
+		return
+	}
+
+	publishHomieDevice(bridge)
+	for _, number := range removed {
+		log.Info().Msgf("Remove Homie node: %s", number)
+		id := homieID(number)
+		var topics []string
+		if bridge.HomieVersion != 5 {
+			topics = append(topics, "$name", "$type", "$properties")
+		}
+
+		for _, property := range homieProperties {
+			topics = append(topics, property.ID)
+			if bridge.HomieVersion != 5 {
+				topics = append(topics, property.ID+"/$name", property.ID+"/$datatype",
+					property.ID+"/$format", property.ID+"/$unit", property.ID+"/$settable")
+			}
+		}
+
+		for _, topic := range topics {
+			publishHomie(bridge, fmt.Sprint(id, "/", topic), "")
+		}
+	}
+}
+
+// disconnectHomie sets the $state of the device to disconnected before the
+// connection is closed.
+func disconnectHomie(bridge *bridgeCfg) {
+	if bridge.HomieClient == nil || !bridge.HomieClient.IsConnected() {
+		return
+	}
+
+	publishHomie(bridge, "$state", "disconnected")
+	bridge.HomieClient.Disconnect(250)
+}
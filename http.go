@@ -0,0 +1,72 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed web
+var web embed.FS
+
+// startHTTP listens on the address of -http, if defined, and serves
+// the endpoints of the bridge.
+func startHTTP(bridge *bridgeCfg, address string) {
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", metricsHandler(bridge))
+	mux.HandleFunc("GET /healthz", handleHealth(bridge))
+	mux.HandleFunc("GET /readyz", handleReady(bridge))
+	mux.HandleFunc("GET /api/rooms", handleRooms)
+	mux.HandleFunc("GET /api/rooms/{id}", handleRoom)
+	mux.HandleFunc("PUT /api/rooms/{id}", handleRoomUpdate(bridge))
+	mux.HandleFunc("GET /api/system", handleSystem(bridge))
+	mux.HandleFunc("GET /api/events", handleEvents)
+	mux.HandleFunc("GET /api/ws", handleWebSocket)
+
+	dashboard, _ := fs.Sub(web, "web")
+	mux.Handle("GET /", http.FileServerFS(dashboard))
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal().Err(err).Str("address", address).Msg("Cannot listen")
+	}
+
+	log.Info().Str("address", listener.Addr().String()).Msg("Listen HTTP")
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Error().Err(err).Msg("HTTP server stopped")
+		}
+	}()
+}
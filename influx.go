@@ -0,0 +1,155 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The influx sink writes the line protocol of InfluxDB, see
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+// to the write API of InfluxDB 2 (http, https) or to the UDP listener (udp).
+
+type influxSink struct {
+	URL    *url.URL
+	Org    string
+	Bucket string
+	Token  string
+	Client http.Client
+}
+
+func newInfluxSink(opts *bridgeOptions) *influxSink {
+	u, _ := url.Parse(opts.Influx) // validated by validateOptions
+	return &influxSink{
+		URL:    u,
+		Org:    opts.InfluxOrg,
+		Bucket: opts.InfluxBucket,
+		Token:  opts.InfluxToken,
+		Client: http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *influxSink) Name() string {
+	return "influx"
+}
+
+var influxMeasurementEscape = strings.NewReplacer(",", `\,`, " ", `\ `)
+var influxTagEscape = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+var influxStringEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func influxField(value any) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v) + "i"
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return `"` + influxStringEscape.Replace(fmt.Sprint(v)) + `"`
+	}
+}
+
+// influxLine returns the point in line protocol. Empty tags are skipped.
+func influxLine(p point) string {
+	var line strings.Builder
+	line.WriteString(influxMeasurementEscape.Replace(p.Measurement))
+	for _, key := range slices.Sorted(maps.Keys(p.Tags)) {
+		if p.Tags[key] != "" {
+			line.WriteString("," + influxTagEscape.Replace(key) + "=" + influxTagEscape.Replace(p.Tags[key]))
+		}
+	}
+
+	var fields []string
+	for _, key := range slices.Sorted(maps.Keys(p.Fields)) {
+		fields = append(fields, influxTagEscape.Replace(key)+"="+influxField(p.Fields[key]))
+	}
+	line.WriteString(" " + strings.Join(fields, ","))
+	line.WriteString(" " + strconv.FormatInt(p.Time.UnixNano(), 10))
+	return line.String()
+}
+
+func (s *influxSink) Write(points []point) error {
+	var lines []string
+	for _, p := range points {
+		lines = append(lines, influxLine(p))
+	}
+	data := strings.Join(lines, "\n") + "\n"
+
+	if s.URL.Scheme == "udp" {
+		return s.writeUDP(data)
+	}
+	return s.writeHTTP(data)
+}
+
+func (s *influxSink) writeUDP(data string) error {
+	conn, err := net.Dial("udp", s.URL.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	_, err = conn.Write([]byte(data))
+	return err
+}
+
+func (s *influxSink) writeHTTP(data string) error {
+	query := url.Values{}
+	query.Set("bucket", s.Bucket)
+	query.Set("org", s.Org)
+	query.Set("precision", "ns")
+
+	u := s.URL.JoinPath("api/v2/write")
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Token)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("write failed with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// components which have their own log level
+var logComponents = []string{"controller", "mqtt", "scheduler"}
+
+// loggers of the components, those are replaced by setLogging at startup
+// only as they are used by any goroutine
+var (
+	controllerLog = log.Logger // HTTP requests to the EnergyLogic
+	mqttLog       = log.Logger // connection and messages of the broker
+	schedulerLog  = log.Logger // polling, refresh and writes queue
+)
+
+func setLogger() {
+	zerolog.TimeFieldFormat = time.DateTime
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: zerolog.TimeFieldFormat})
+}
+
+// parseLogLevels parses levels like "info" or "info,controller=debug,mqtt=warn".
+// The first level without component is the default of every component.
+func parseLogLevels(levels string) (zerolog.Level, map[string]zerolog.Level, error) {
+	base := zerolog.InfoLevel
+	components := map[string]zerolog.Level{}
+	for _, item := range strings.Split(levels, ",") {
+		component, value, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			value = component
+		}
+
+		level, err := zerolog.ParseLevel(value)
+		if err != nil || value == "" {
+			return base, nil, fmt.Errorf("unknown level %q", value)
+		}
+
+		if !found {
+			base = level
+		} else if slices.Contains(logComponents, component) {
+			components[component] = level
+		} else {
+			return base, nil, fmt.Errorf("unknown component %q, use %s", component, strings.Join(logComponents, ", "))
+		}
+	}
+	return base, components, nil
+}
+
+// setLogging applies the format and the levels of the options. The verbose
+// option lowers the default level to debug.
+func setLogging(opts *bridgeOptions) {
+	if opts.LogFormat == "json" {
+		zerolog.TimeFieldFormat = time.RFC3339
+		log.Logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
+	} else {
+		setLogger()
+	}
+
+	base, components, _ := parseLogLevels(opts.LogLevel) // validated by validateOptions
+	if opts.Verbose && base > zerolog.DebugLevel {
+		base = zerolog.DebugLevel
+	}
+
+	// the global level must not filter any component
+	lowest := base
+	for _, level := range components {
+		lowest = min(lowest, level)
+	}
+	zerolog.SetGlobalLevel(lowest)
+
+	logger := func(component string) zerolog.Logger {
+		level, found := components[component]
+		if !found {
+			level = base
+		}
+		return log.Logger.With().Str("component", component).Logger().Level(level)
+	}
+
+	controllerLog = logger("controller")
+	mqttLog = logger("mqtt")
+	schedulerLog = logger("scheduler")
+	log.Logger = log.Logger.Level(base)
+}
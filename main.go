@@ -24,34 +24,47 @@
 package main
 
 import (
-	"bytes"
 	"crypto/tls"
-	"encoding/json"
 	"encoding/xml"
-	"flag"
 	"fmt"
-	"io"
+	"maps"
+	"math"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	DNS "github.com/ncruces/go-dns"
 )
 
+var version = "dev"
+
 var bridge *bridgeCfg
 
 var lastTempChange = make(map[string]tempChange)
 
+// range of the limits of the target temperature in Celsius
+const temperatureLimitMin = 5.0
+const temperatureLimitMax = 30.0
+
+// temperatureLimits returns the range of the limits in the unit of a room.
+func temperatureLimits(unit string) (float64, float64) {
+	if unit == "F" {
+		return temperatureLimitMin*9/5 + 32, temperatureLimitMax*9/5 + 32
+	}
+	return temperatureLimitMin, temperatureLimitMax
+}
+
 var systemFields []string
 var systemFieldsAdditional []string
 
@@ -66,48 +79,6 @@ type tempChange struct {
 	MaxTemp float64
 }
 
-type jsonClimateDiscoveryDevice struct {
-	Identifier string     `json:"identifiers"`
-	Name       string     `json:"name"`
-	Cns        [][]string `json:"cns"`
-}
-
-type jsonClimateAvailability struct {
-	Topic string `json:"topic"`
-	//Avail    string `json:"pl_avail"`
-	//NotAvail string `json:"pl_not_avail"`
-}
-
-type jsonClimateDiscovery struct {
-	Name      string                     `json:"name"`
-	ModeCmdT  string                     `json:"mode_cmd_t"`
-	ModeStatT string                     `json:"mode_stat_t"`
-	Avty      []jsonClimateAvailability  `json:"avty"`
-	AvtyMode  string                     `json:"avty_mode"`
-	TempCmdT  string                     `json:"temp_cmd_t"`
-	TempStatT string                     `json:"temp_stat_t"`
-	CurrTempT string                     `json:"curr_temp_t"`
-	TempUnit  string                     `json:"temp_unit"`
-	MinTemp   string                     `json:"min_temp"`
-	MaxTemp   string                     `json:"max_temp"`
-	TempStep  string                     `json:"temp_step"`
-	Modes     []string                   `json:"modes"`
-	Device    jsonClimateDiscoveryDevice `json:"device"`
-	UniqueID  string                     `json:"unique_id"`
-}
-
-type jsonSensorDiscovery struct {
-	Name              string                     `json:"name"`
-	Avty              []jsonClimateAvailability  `json:"avty"`
-	AvtyMode          string                     `json:"avty_mode"`
-	StateTopic        string                     `json:"stat_t"`
-	UnitOfMeasurement string                     `json:"unit_of_meas"`
-	StateClass        string                     `json:"stat_cla"`
-	DeviceClass       string                     `json:"dev_cla"`
-	Device            jsonClimateDiscoveryDevice `json:"device"`
-	UniqueID          string                     `json:"unique_id"`
-}
-
 type content struct {
 	XMLName xml.Name       `xml:"content"`
 	Entries []contentValue `xml:"field"`
@@ -123,21 +94,49 @@ type writeEvent struct {
 	Prefix string
 	Name   string
 	Value  string
+	Result chan bool // optional and buffered, receives the result of the write
 }
 
 type bridgeCfg struct {
 	KeepRunning         chan bool
+	ReloadChannel       chan bool
+	StatusChannel       chan bool
+	Ticker              *time.Ticker
+	Options             *bridgeOptions
 	Client              MQTT.Client
 	WriteChannel        chan writeEvent
 	RefreshRoomChannel  chan string
 	HeatingURL          string
 	Polling             int
 	TempChange          int
+	Debounce            time.Duration
+	RateLimit           time.Duration
 	Topic               string
 	Sensor              bool
+	Discovery           string
+	RetainDiscovery     bool
+	DeviceDiscovery     bool
 	FullInformation     bool
 	LastNumberOfDevices int
 	SystemInformation   map[string]string
+	Rooms               map[string]roomCfg
+	RemoveGrace         time.Duration
+	VanishedRooms       map[string]time.Time
+	PublishedRooms      map[string]bool // rooms which are added and not removed yet
+	HomieClient         MQTT.Client
+	HomieTopic          string
+	HomieVersion        int
+	HomieNodes          map[string]homieNode
+	HomieDescription    string
+	HomieMutex          sync.Mutex // guards HomieNodes and HomieDescription
+	PollStart           time.Time
+	PollRooms           map[string]bool // rooms of the poll which are not refreshed yet
+	Sinks               []sink
+	SinkChannel         chan []point
+	PollPoints          []point // points of the poll for the sinks
+	StartTime           time.Time
+	ReadOnly            atomic.Bool // read by the writing goroutine and HTTP handlers
+	CleanDiscovery      map[string]bool
 }
 
 func identifier(bridge *bridgeCfg) string {
@@ -149,10 +148,34 @@ func setupCloseHandler(bridge *bridgeCfg) {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		disconnectHomie(bridge)
 		bridge.KeepRunning <- false
 	}()
 }
 
+func setupReloadHandler(bridge *bridgeCfg) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			requestReload(bridge)
+		}
+	}()
+}
+
+func setupStatusHandler(bridge *bridgeCfg) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			select {
+			case bridge.StatusChannel <- true:
+			default: // a status is already pending
+			}
+		}
+	}()
+}
+
 func stringSuffixInSlice(value string, list []string) bool {
 	for _, entry := range list {
 		if strings.HasSuffix(value, entry) {
@@ -180,58 +203,58 @@ func generateXML(values []string, prefix string) string {
 }
 
 func fetch(ip string, values []string, prefix string) content {
-	url := "http://" + ip + "/cgi-bin/ILRReadValues.cgi"
 	xmlValue := generateXML(values, prefix)
 	var c content
 
-	resp, err := http.Post(url, "text/xml", bytes.NewBuffer([]byte(xmlValue)))
-	if err != nil {
-		log.Error().Err(err).Msg("Cannot fetch data")
-		return c
-	}
-
-	defer resp.Body.Close() //nolint:errcheck
-	body, err := io.ReadAll(resp.Body)
+	controllerLog.Debug().Str("prefix", prefix).Int("values", len(values)).Msg("Fetch")
+	body, err := controllerRequest(ip, "/cgi-bin/ILRReadValues.cgi", xmlValue)
 	if err != nil {
-		log.Error().Err(err).Bytes("body", body).Msg("Cannot read body")
+		controllerLog.Error().Err(err).Msg("Cannot fetch data")
+		metrics.addFetchError(err)
+		health.fetched(err)
 		return c
 	}
 
-	err = xml.Unmarshal(body, &c)
+	err = xml.Unmarshal([]byte(body), &c)
 	if err != nil {
-		log.Error().Err(err).Bytes("body", body).Msg("Cannot parse body")
+		controllerLog.Error().Err(err).Str("body", body).Msg("Cannot parse body")
+		metrics.addFetchError(err)
+		health.fetched(err)
 		return c
 	}
 
+	health.fetched(nil)
 	return c
 }
 
-func checkTemperatureSanity(prefix string, value string) bool {
+func checkTemperatureSanity(prefix string, name string, value string) bool {
 	lastChange := lastTempChange[prefix]
+	room, _ := states.room(prefix)
+	limitMin, limitMax := temperatureLimits(room.Unit)
 
 	if userValue, err := strconv.ParseFloat(value, 64); err == nil {
+		switch name {
+		case "SollTempMinVal":
+			return userValue >= limitMin && userValue <= lastChange.MaxTemp
+		case "SollTempMaxVal":
+			return userValue <= limitMax && userValue >= lastChange.MinTemp
+		}
 		return userValue <= lastChange.MaxTemp && userValue >= lastChange.MinTemp
 	}
 
-	log.Error().Str("value", value).Float64("minTemp", lastChange.MinTemp).Float64("maxTemp", lastChange.MaxTemp).Msg("Cannot convert compare values")
+	controllerLog.Error().Str("value", value).Float64("minTemp", lastChange.MinTemp).Float64("maxTemp", lastChange.MaxTemp).Msg("Cannot convert compare values")
 	return false
 }
 
 func propagate(bridge *bridgeCfg, name string, value string, prefix string) bool {
 	if stringSuffixInSlice(name, roomFieldsTemperature) {
-		if !checkTemperatureSanity(prefix, value) {
-			log.Error().Str("value", value).Msg("Propagate canceled | Value is not valid")
+		if !checkTemperatureSanity(prefix, name, value) {
+			controllerLog.Error().Str("value", value).Msg("Propagate canceled | Value is not valid")
 			return false
 		}
 
-		if len(value) > 5 {
-			value = value[:5] // cut off 20.123456789
-		}
-
-		value = strings.ReplaceAll(value, ".", "")
-		for i := len(value); i < 4; i++ {
-			value += "0"
-		}
+		userValue, _ := strconv.ParseFloat(value, 64)
+		value = fmt.Sprintf("%04d", int(math.Round(userValue*100))) // 5.5 => 0550
 	} else if stringSuffixInSlice(name, []string{"OPMode"}) {
 		if strings.EqualFold(value, "heat") || strings.EqualFold(value, "on") {
 			value = "0"
@@ -247,136 +270,85 @@ func propagate(bridge *bridgeCfg, name string, value string, prefix string) bool
 	}
 
 	data := prefix + "." + name + "=" + url.QueryEscape(value)
-	url := "http://" + bridge.HeatingURL + "/cgi-bin/writeVal.cgi?" + data
+	request := "/cgi-bin/writeVal.cgi?" + data
 
-	log.Info().Str("data", data).Msg("Propagate")
-	resp, err := http.Get(url)
+	if bridge.ReadOnly.Load() {
+		controllerLog.Warn().Str("data", data).Msg("Propagate skipped | Read-only")
+		publish(bridge, bridge.Topic+"/bridge/readonly", "http://"+bridge.HeatingURL+request, false)
+		return true
+	}
+
+	controllerLog.Info().Str("data", data).Msg("Propagate")
+	body, err := controllerRequest(bridge.HeatingURL, request, "")
 	if err == nil {
-		defer resp.Body.Close() //nolint:errcheck
-		body, _ := io.ReadAll(resp.Body)
-		bridge.RefreshRoomChannel <- prefix
-		return string(body) == value
+		if strings.HasPrefix(prefix, "G") {
+			bridge.RefreshRoomChannel <- prefix
+		} else {
+			bridge.RefreshRoomChannel <- ""
+		}
+		return body == value
 	}
 
-	log.Error().Err(err).Msg("Propagate failed")
+	controllerLog.Error().Err(err).Msg("Propagate failed")
+	metrics.addError(err)
 	return false
 }
 
+// checkLastTempChange returns false if the temperature of the room has no
+// changes in time.
 func checkLastTempChange(bridge *bridgeCfg, number string, value string,
-	sollTempMin string, sollTempMax string) {
+	sollTempMin string, sollTempMax string) (available bool) {
 	prefix := bridge.Topic + "/" + number
 	deferedState := "online"
 	defer func(state *string) {
+		battery := "OFF"
+		if *state == "offline" {
+			battery = "ON" // low battery
+		}
+
 		publish(bridge, prefix+"/available", *state, true)
+		publish(bridge, prefix+"/battery", battery, true)
+		publish(bridge, prefix+"/RaumTempLastChange", lastTempChange[number].Time.Format(time.RFC3339), true)
+		available = *state == "online"
 	}(&deferedState)
 
+	hours := bridge.TempChange
+	if room := bridge.Rooms[number]; room.TempChange != nil {
+		hours = *room.TempChange
+	}
+
+	minTemp, _ := strconv.ParseFloat(sollTempMin, 64)
+	maxTemp, _ := strconv.ParseFloat(sollTempMax, 64)
+
 	lastChange := lastTempChange[number]
 	if lastChange.Temp == value {
-		maxLastChangeTime := lastChange.Time.Add(time.Hour * time.Duration(bridge.TempChange))
+		lastChange.MinTemp = minTemp
+		lastChange.MaxTemp = maxTemp
+		lastTempChange[number] = lastChange
+
+		maxLastChangeTime := lastChange.Time.Add(time.Hour * time.Duration(hours))
 		if time.Now().After(maxLastChangeTime) {
 			log.Info().Str("room", number).Msg("No temperature change")
 			deferedState = "offline"
-			publish(bridge, prefix+"/RaumTempLastChange", lastChange.Time.String(), false)
 		}
 		return
 	}
 
-	minTemp, _ := strconv.ParseFloat(sollTempMin, 64)
-	maxTemp, _ := strconv.ParseFloat(sollTempMax, 64)
 	lastTempChange[number] = tempChange{
 		Temp:    value,
 		Time:    time.Now(),
 		MinTemp: minTemp,
 		MaxTemp: maxTemp,
 	}
+	return
 }
 
 func publish(bridge *bridgeCfg, topic string, value string, retained bool) {
+	mqttLog.Debug().Str("topic", topic).Str("value", value).Bool("retained", retained).Msg("Publish")
 	token := bridge.Client.Publish(topic, 0, retained, value)
 	token.Wait()
 	if token.Error() != nil {
-		log.Error().Err(token.Error()).Str("value", value).Str("topic", topic).Msg("Cannot publish value")
-	}
-}
-
-func publishJSON(bridge *bridgeCfg, number string, name string, siUnit string,
-	sollTempMin string, sollTempMax string) {
-	id := identifier(bridge)
-	prefix := bridge.Topic + "/" + number
-	switch siUnit {
-	case "0":
-		siUnit = "C"
-	case "1":
-		siUnit = "F"
-	}
-
-	mac := strings.ReplaceAll(bridge.SystemInformation["hw.Addr"], "-", ":")
-	jsonDiscoveryDevice := jsonClimateDiscoveryDevice{
-		Identifier: id,
-		Name:       id,
-		Cns:        [][]string{{"mac", mac}},
-	}
-
-	jsonAvailability := []jsonClimateAvailability{
-		{
-			Topic: prefix + "/available",
-			//Avail:    "online",
-			//NotAvail: "offline",
-		},
-		{
-			Topic: bridge.Topic + "/available",
-			//Avail:    "online",
-			//NotAvail: "offline",
-		}}
-
-	jsonDiscoveryClimate := jsonClimateDiscovery{
-		Name:      name,
-		Avty:      jsonAvailability,
-		AvtyMode:  "all",
-		UniqueID:  id + "-" + number,
-		Device:    jsonDiscoveryDevice,
-		ModeCmdT:  prefix + "/set/OPMode",
-		ModeStatT: prefix + "/OPMode_mode",
-		TempCmdT:  prefix + "/set/SollTemp",
-		TempStatT: prefix + "/SollTemp",
-		CurrTempT: prefix + "/RaumTemp",
-		TempUnit:  siUnit,
-		MinTemp:   sollTempMin,
-		MaxTemp:   sollTempMax,
-		TempStep:  "0.5",
-		Modes:     []string{"off", "heat"},
-	}
-
-	climateValueJSON, err := json.Marshal(jsonDiscoveryClimate)
-	if err != nil {
-		log.Error().Err(err).Msg("Cannot marshal climate discovery")
-		return
-	}
-
-	climateTopic := "homeassistant/climate/" + id + "/" + number + "/config"
-	publish(bridge, climateTopic, string(climateValueJSON), false)
-
-	if bridge.Sensor {
-		jsonDiscoverySensor := jsonSensorDiscovery{
-			Name:              name,
-			Avty:              jsonAvailability,
-			AvtyMode:          "all",
-			UniqueID:          id + "-sensor-" + number,
-			Device:            jsonDiscoveryDevice,
-			StateTopic:        prefix + "/RaumTemp",
-			UnitOfMeasurement: "°" + siUnit,
-			StateClass:        "measurement",
-			DeviceClass:       "temperature",
-		}
-
-		sensorValueJSON, err := json.Marshal(jsonDiscoverySensor)
-		if err != nil {
-			log.Error().Err(err).Msg("Cannot marshal sensor discovery")
-			return
-		}
-
-		sensorTopic := "homeassistant/sensor/" + id + "/" + number + "/config"
-		publish(bridge, sensorTopic, string(sensorValueJSON), false)
+		mqttLog.Error().Err(token.Error()).Str("value", value).Str("topic", topic).Msg("Cannot publish value")
 	}
 }
 
@@ -422,21 +394,28 @@ func fetchTemperature(name string, value string) string {
 
 func refreshRoomInformation(bridge *bridgeCfg, number string) {
 	c := fetch(bridge.HeatingURL, roomFields, number+".")
+	if len(c.Entries) == 0 {
+		return // keep the last state, the fetch failed
+	}
 
 	name := number
+	opMode := ""
 	siUnit := "0"
 	raumTemp := "0"
 	sollTemp := "0"
 	sollTempMin := "0"
 	sollTempMax := "30"
+	values := map[string]string{}
 
 	for i := 0; i < len(c.Entries); i++ {
 		room := strings.ReplaceAll(c.Entries[i].Name, ".", "/")
 		t := fmt.Sprint(bridge.Topic, "/", room)
 		value := fetchTemperature(room, c.Entries[i].Value)
 		publish(bridge, t, value, true)
+		values[strings.TrimPrefix(c.Entries[i].Name, number+".")] = value
 
 		if strings.HasSuffix(room, "OPMode") {
+			opMode = value
 			switch value {
 			case "0":
 				value = "heat"
@@ -455,6 +434,7 @@ func refreshRoomInformation(bridge *bridgeCfg, number string) {
 				log.Warn().Msgf("TempSIUnit of %s is undefined. Use %s/set/%s", number, bridge.Topic, room)
 			}
 			siUnit = value
+			publish(bridge, t+"_unit", temperatureUnit(value), true)
 		} else if strings.HasSuffix(room, "SollTempMinVal") {
 			sollTempMin = value
 		} else if strings.HasSuffix(room, "SollTempMaxVal") {
@@ -462,54 +442,165 @@ func refreshRoomInformation(bridge *bridgeCfg, number string) {
 		}
 	}
 
-	checkLastTempChange(bridge, number, raumTemp, sollTempMin, sollTempMax)
+	room := bridge.Rooms[number]
+	if room.Name != "" {
+		name = room.Name
+	}
+
+	if room.MinTemp != nil {
+		sollTempMin = strconv.FormatFloat(*room.MinTemp, 'f', -1, 64)
+	}
+
+	if room.MaxTemp != nil {
+		sollTempMax = strconv.FormatFloat(*room.MaxTemp, 'f', -1, 64)
+	}
+
+	available := checkLastTempChange(bridge, number, raumTemp, sollTempMin, sollTempMax)
 	publishJSON(bridge, number, name, siUnit, sollTempMin, sollTempMax)
-	log.Debug().Str("name", name).Str("raumTemp", raumTemp).Str("sollTemp", sollTemp).Time("tempChange", lastTempChange[number].Time).Msg(number)
+	states.setRoom(number, func(room *roomState) {
+		room.Name = name
+		room.Temperature = parseFloat(raumTemp)
+		room.TargetTemperature = parseFloat(sollTemp)
+		room.MinTemperature = parseFloat(sollTempMin)
+		room.MaxTemperature = parseFloat(sollTempMax)
+		room.Unit = temperatureUnit(siUnit)
+		room.Mode, _ = strconv.Atoi(opMode)
+		room.Available = available
+		room.LastTemperatureChange = lastTempChange[number].Time
+		room.Values = values
+	})
+	collectPoint(bridge, number)
+	publishHomieRoom(bridge, number, homieNode{
+		Name:    name,
+		Unit:    temperatureUnit(siUnit),
+		MinTemp: sollTempMin,
+		MaxTemp: sollTempMax,
+	}, map[string]string{"RaumTemp": raumTemp, "SollTemp": sollTemp, "OPMode": opMode, "name": name})
+	schedulerLog.Debug().Str("name", name).Str("raumTemp", raumTemp).Str("sollTemp", sollTemp).Time("tempChange", lastTempChange[number].Time).Msg(number)
 }
 
 func refresh(bridge *bridgeCfg) {
+	start := time.Now()
 	publish(bridge, bridge.Topic+"/available", "online", true)
 	totalNumberOfDevices := refreshSystemInformation(bridge)
+	if len(bridge.SystemInformation) == 0 {
+		// keep the rooms, the EnergyLogic is not reachable
+		metrics.addPoll(time.Since(start))
+		publishStatus(bridge)
+		return
+	}
+	states.setSystem(bridge.SystemInformation)
+	health.polled(bridge.Polling)
 
 	if bridge.LastNumberOfDevices == -1 {
 		bridge.LastNumberOfDevices = 0 // initialized!
 		log.Info().Msgf("Host: %s", identifier(bridge))
 		listenStateHA(bridge)
+		listenCommands(bridge)
+		bridge.CleanDiscovery["controller"] = true
 	}
 
+	publishControllerDiscovery(bridge)
+
 	if totalNumberOfDevices > bridge.LastNumberOfDevices {
 		firstNewDevice := totalNumberOfDevices - (totalNumberOfDevices - bridge.LastNumberOfDevices)
 		for i := firstNewDevice; i < totalNumberOfDevices; i++ {
 			prefix := fmt.Sprint("G", i)
-			log.Info().Msgf("Add room: %s", prefix)
-			for _, name := range roomSetFields {
-				topic := fmt.Sprint(bridge.Topic, "/", prefix, "/set/", name)
-				listen(bridge, topic)
+			if bridge.Rooms[prefix].Exclude {
+				log.Info().Msgf("Exclude room: %s", prefix)
+				removeRoom(bridge, prefix)
+				delete(bridge.PublishedRooms, prefix)
+				continue
 			}
-		}
 
-		bridge.LastNumberOfDevices = totalNumberOfDevices
+			log.Info().Msgf("Add room: %s", prefix)
+			subscribeRoom(bridge, prefix)
+			bridge.PublishedRooms[prefix] = true
+			bridge.CleanDiscovery[prefix] = true
+		}
+	}
+	bridge.LastNumberOfDevices = totalNumberOfDevices
 
-	} else if totalNumberOfDevices < bridge.LastNumberOfDevices {
-		for i := totalNumberOfDevices; i < bridge.LastNumberOfDevices; i++ {
-			prefix := fmt.Sprint("G", i)
-			log.Info().Msgf("Remove room: %s", prefix)
-			for _, name := range roomSetFields {
-				topic := fmt.Sprint(bridge.Topic, "/", prefix, "/set/", name)
-				bridge.Client.Unsubscribe(topic)
-			}
+	// a reconnect or reload resets the counter, so compare with the published rooms
+	for _, prefix := range slices.Sorted(maps.Keys(bridge.PublishedRooms)) {
+		if _, found := bridge.VanishedRooms[prefix]; found || roomIndex(prefix) < totalNumberOfDevices {
+			continue
 		}
 
-		bridge.LastNumberOfDevices = totalNumberOfDevices
+		log.Info().Msgf("Remove room: %s", prefix)
+		unsubscribeRoom(bridge, prefix)
+		bridge.VanishedRooms[prefix] = time.Now()
 	}
 
+	removeVanishedRooms(bridge, totalNumberOfDevices)
+	removeHomieRooms(bridge, totalNumberOfDevices)
+	removeRoomStates(bridge, totalNumberOfDevices)
+
+	// the poll is done by the refresh of the last room, see pollDone
+	bridge.PollStart = start
+	bridge.PollRooms = make(map[string]bool)
+	bridge.PollPoints = nil
 	for i := 0; i < totalNumberOfDevices; i++ {
-		bridge.RefreshRoomChannel <- fmt.Sprint("G", i)
+		prefix := fmt.Sprint("G", i)
+		if !bridge.Rooms[prefix].Exclude {
+			bridge.PollRooms[prefix] = true
+			bridge.RefreshRoomChannel <- prefix
+		}
+	}
+
+	if len(bridge.PollRooms) == 0 {
+		metrics.addPoll(time.Since(start))
+		publishStatus(bridge)
+	}
+}
+
+// pollDone completes the poll if the last room of it has been refreshed.
+func pollDone(bridge *bridgeCfg, number string) {
+	if !bridge.PollRooms[number] {
+		return
+	}
+
+	delete(bridge.PollRooms, number)
+	if len(bridge.PollRooms) == 0 {
+		queuePoints(bridge)
+		metrics.addPoll(time.Since(bridge.PollStart))
+		publishStatus(bridge)
+	}
+}
+
+// removeVanishedRooms clears the discovery and the retained state of rooms
+// which are missing longer than the grace period.
+func removeVanishedRooms(bridge *bridgeCfg, totalNumberOfDevices int) {
+	for prefix, since := range bridge.VanishedRooms {
+		number, _ := strconv.Atoi(strings.TrimPrefix(prefix, "G"))
+		if number < totalNumberOfDevices {
+			log.Info().Msgf("Room is back: %s", prefix)
+			delete(bridge.VanishedRooms, prefix)
+			continue
+		}
+
+		if time.Since(since) < bridge.RemoveGrace {
+			continue
+		}
+
+		log.Info().Msgf("Remove discovery of room: %s", prefix)
+		removeRoom(bridge, prefix)
+		delete(bridge.VanishedRooms, prefix)
+		delete(bridge.PublishedRooms, prefix)
+		delete(lastTempChange, prefix)
+	}
+}
+
+// removeRoom clears the discovery and the retained state of a room.
+func removeRoom(bridge *bridgeCfg, prefix string) {
+	removeDiscovery(bridge, prefix)
+	for _, name := range roomStateFields() {
+		publish(bridge, bridge.Topic+"/"+prefix+"/"+name, "", true)
 	}
 }
 
 func listenStateHA(bridge *bridgeCfg) {
-	bridge.Client.Subscribe("homeassistant/status", 0, func(client MQTT.Client, msg MQTT.Message) {
+	bridge.Client.Subscribe(bridge.Discovery+"/status", 0, func(client MQTT.Client, msg MQTT.Message) {
 		payload := string(msg.Payload())
 		if payload == "online" {
 			bridge.RefreshRoomChannel <- ""
@@ -517,6 +608,52 @@ func listenStateHA(bridge *bridgeCfg) {
 	})
 }
 
+func listenCommands(bridge *bridgeCfg) {
+	commands := map[string]func(){
+		"reload":  func() { requestReload(bridge) },
+		"refresh": func() { bridge.RefreshRoomChannel <- "" },
+		// discovery is published on every refresh
+		"republish": func() { bridge.RefreshRoomChannel <- "" },
+		"synctime":  func() { syncTime(bridge) },
+	}
+
+	for command, action := range commands {
+		bridge.Client.Subscribe(bridge.Topic+"/bridge/"+command, 0, func(client MQTT.Client, msg MQTT.Message) {
+			mqttLog.Info().Str("command", command).Msg("Received command")
+			action()
+		})
+	}
+}
+
+// syncTime sets the clock of the EnergyLogic to the clock of the bridge.
+func syncTime(bridge *bridgeCfg) {
+	bridge.WriteChannel <- writeEvent{
+		Prefix: "R0",
+		Name:   "DateTime",
+		Value:  strconv.FormatInt(time.Now().Unix(), 10),
+	}
+}
+
+func subscribeRoom(bridge *bridgeCfg, prefix string) {
+	for _, name := range roomSetFields {
+		topic := fmt.Sprint(bridge.Topic, "/", prefix, "/set/", name)
+		listen(bridge, topic)
+	}
+
+	bridge.Client.Subscribe(bridge.Topic+"/"+prefix+"/refresh", 0, func(client MQTT.Client, msg MQTT.Message) {
+		bridge.RefreshRoomChannel <- prefix
+	})
+}
+
+func unsubscribeRoom(bridge *bridgeCfg, prefix string) {
+	for _, name := range roomSetFields {
+		topic := fmt.Sprint(bridge.Topic, "/", prefix, "/set/", name)
+		bridge.Client.Unsubscribe(topic)
+	}
+
+	bridge.Client.Unsubscribe(bridge.Topic + "/" + prefix + "/refresh")
+}
+
 func listen(bridge *bridgeCfg, topic string) {
 	bridge.Client.Subscribe(topic, 0, func(client MQTT.Client, msg MQTT.Message) {
 		payload := string(msg.Payload())
@@ -532,70 +669,181 @@ func listen(bridge *bridgeCfg, topic string) {
 	})
 }
 
-func running(bridge *bridgeCfg) {
-	log.Debug().Msg("Running...")
-	ticker := time.NewTicker(time.Duration(bridge.Polling) * time.Second)
+func nextWrite(due map[string]time.Time) (string, time.Time) {
+	key := ""
+	var next time.Time
+	for k, t := range due {
+		if key == "" || t.Before(next) {
+			key = k
+			next = t
+		}
+	}
+	return key, next
+}
 
-	go func() {
-		for {
-			select {
-			case <-bridge.KeepRunning:
-				return
-			case <-ticker.C:
-				bridge.RefreshRoomChannel <- ""
+// debounceMaxWait limits the delay of a write by steady events to a multiple
+// of the debounce.
+const debounceMaxWait = 5
+
+// writing coalesces writes to the same room field within the debounce window,
+// so only the last value is sent, and keeps a minimum gap between controller writes.
+func writing(bridge *bridgeCfg) {
+	pending := make(map[string]writeEvent)
+	waiting := make(map[string][]chan bool)
+	due := make(map[string]time.Time)
+	first := make(map[string]time.Time)
+	var lastWrite time.Time
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	schedule := func() {
+		key, next := nextWrite(due)
+		if key == "" {
+			return
+		}
+
+		if earliest := lastWrite.Add(bridge.RateLimit); next.Before(earliest) {
+			next = earliest
+		}
+		timer.Reset(time.Until(next))
+	}
+
+	for {
+		select {
+		case <-bridge.KeepRunning:
+			return
+		case event := <-bridge.WriteChannel:
+			key := event.Prefix + "." + event.Name
+			if old, found := pending[key]; found {
+				schedulerLog.Debug().Str("key", key).Str("old", old.Value).Str("value", event.Value).Msg("Coalesce write")
+			} else {
+				first[key] = time.Now()
+			}
+			// every event pushes the write back, but not forever
+			due[key] = time.Now().Add(bridge.Debounce)
+			if latest := first[key].Add(debounceMaxWait * bridge.Debounce); due[key].After(latest) {
+				due[key] = latest
+			}
+			pending[key] = event
+			if event.Result != nil {
+				waiting[key] = append(waiting[key], event.Result)
+			}
+			schedule()
+		case <-timer.C:
+			key, next := nextWrite(due)
+			if key == "" || time.Now().Before(next) || time.Since(lastWrite) < bridge.RateLimit {
+				schedule()
+				continue
+			}
+
+			event := pending[key]
+			results := waiting[key]
+			delete(pending, key)
+			delete(waiting, key)
+			delete(due, key)
+			delete(first, key)
+			lastWrite = time.Now()
+			schedulerLog.Debug().Str("key", key).Int("waiting", len(results)).Msg("Write")
+			success := propagate(bridge, event.Name, event.Value, event.Prefix)
+			metrics.addWrite(success)
+			for _, result := range results {
+				result <- success
 			}
+			schedule()
 		}
-	}()
+	}
+}
+
+func running(bridge *bridgeCfg) {
+	schedulerLog.Debug().Msg("Running...")
+	bridge.Ticker = time.NewTicker(time.Duration(bridge.Polling) * time.Second)
 
 	go func() {
 		for {
 			select {
 			case <-bridge.KeepRunning:
 				return
-			case event := <-bridge.WriteChannel:
-				propagate(bridge, event.Name, event.Value, event.Prefix)
+			case <-bridge.Ticker.C:
+				bridge.RefreshRoomChannel <- ""
 			}
 		}
 	}()
 
+	go writing(bridge)
+	go writeSinks(bridge)
+
 	go func() {
 		for {
 			select {
 			case <-bridge.KeepRunning:
 				return
 			case room := <-bridge.RefreshRoomChannel:
+				schedulerLog.Debug().Str("room", room).Msg("Refresh")
 				if room == "" {
 					refresh(bridge)
 				} else {
 					refreshRoomInformation(bridge, room)
+					pollDone(bridge, room)
 				}
+			case <-bridge.ReloadChannel:
+				reload(bridge)
+			case <-bridge.StatusChannel:
+				publishStatus(bridge)
 			}
 		}
 	}()
 }
 
 func attemptHandler(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
-	log.Debug().Stringer("broker", broker).Msg("Connecting...")
+	mqttLog.Debug().Stringer("broker", broker).Msg("Connecting...")
 	return tlsCfg
 }
 
 func connectHandler(client MQTT.Client) {
-	log.Debug().Msg("Connected")
+	mqttLog.Debug().Msg("Connected")
+	metrics.addConnect()
 	// just reset if connection was lost
 	bridge.LastNumberOfDevices = -1
 	bridge.RefreshRoomChannel <- ""
 }
 
 func connectLostHandler(client MQTT.Client, err error) {
-	log.Warn().Err(err).Msg("Connection lost")
+	mqttLog.Warn().Err(err).Msg("Connection lost")
+	metrics.addError(err)
+}
+
+// brokerCredentials are requested on every connect, so a reload changes
+// them for the next reconnect.
+type brokerCredentials struct {
+	mutex    sync.Mutex
+	User     string
+	Password string
+}
+
+var credentials = &brokerCredentials{}
+
+func (c *brokerCredentials) get() (string, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.User, c.Password
+}
+
+// set returns true if the credentials have been changed.
+func (c *brokerCredentials) set(user string, password string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	changed := c.User != user || c.Password != password
+	c.User = user
+	c.Password = password
+	return changed
 }
 
-func createClientOptions(broker string, user string, password string, cleansess bool, topic string) *MQTT.ClientOptions {
+func createClientOptions(broker string, cleansess bool, topic string) *MQTT.ClientOptions {
 	opts := MQTT.NewClientOptions()
 	opts.AddBroker(broker)
 	opts.SetClientID("HeatingMqttBridge")
-	opts.SetUsername(user)
-	opts.SetPassword(password)
+	opts.SetCredentialsProvider(credentials.get)
 	opts.SetCleanSession(cleansess)
 	opts.SetConnectionAttemptHandler(attemptHandler)
 	opts.SetOnConnectHandler(connectHandler)
@@ -604,114 +852,51 @@ func createClientOptions(broker string, user string, password string, cleansess
 	return opts
 }
 
-func setStringParam(param *string, envName string, useEnv bool, defaultValue string, required bool) {
-	if *param == "" {
-		if useEnv {
-			*param = os.Getenv(envName)
-		}
-
-		if *param == "" {
-			*param = defaultValue
-		}
-	}
-
-	if required && *param == "" {
-		log.Fatal().Msgf("%s is not defined", envName)
-	}
-}
-
-func setBoolParam(value *bool, name string) {
-	if !isFlagPassed(name) {
-		if v, err := strconv.ParseBool(os.Getenv(strings.ToUpper(name))); err == nil {
-			*value = v
-		}
-	}
-}
-
-func isFlagPassed(name string) bool {
-	found := false
-	flag.Visit(func(f *flag.Flag) {
-		if f.Name == name {
-			found = true
-		}
-	})
-	return found
-}
-
-func createBridge() *bridgeCfg {
-	env := flag.Bool("env", false, "Allow environment variables if provided")
-	heating := flag.String("heating", "", "The IP/hostname of the Roth EnergyLogic")
-	topic := flag.String("topic", "", "The topic name to/from which to publish/subscribe")
-	broker := flag.String("broker", "", "The broker URI. ex: tcp://10.10.1.1:1883")
-	password := flag.String("password", "", "The password (optional)")
-	user := flag.String("user", "", "The User (optional)")
-	clean := flag.Bool("clean", false, "Set clean Session")
-	polling := flag.Int("polling", 300, "Refresh interval in seconds")
-	tempchange := flag.Int("tempchange", 12, "Temperature change warning in hours")
-	full := flag.Bool("full", false, "Provide full information to broker")
-	sensor := flag.Bool("sensor", true, "Send additional sensor entity")
-	dnsCache := flag.Bool("dns", true, "Use internal DNS cache")
-	verbose := flag.Bool("verbose", false, "Provide verbose log information")
-	flag.Parse()
-
-	setStringParam(heating, "HEATING", *env, "", true)
-	setStringParam(topic, "TOPIC", *env, "roth", true)
-	setStringParam(broker, "BROKER", *env, "", true)
-	setStringParam(user, "BROKER_USER", *env, "", false)
-	setStringParam(password, "BROKER_PSW", *env, "", false)
-
-	if *env {
-		setBoolParam(clean, "clean")
-		setBoolParam(full, "full")
-		setBoolParam(sensor, "sensor")
-		setBoolParam(dnsCache, "dns")
-		setBoolParam(verbose, "verbose")
-
-		if !isFlagPassed("polling") {
-			if v, err := strconv.Atoi(os.Getenv("POLLING")); err == nil {
-				*polling = v
-			}
-		}
-
-		if !isFlagPassed("tempchange") {
-			if v, err := strconv.Atoi(os.Getenv("TEMPCHANGE")); err == nil {
-				*tempchange = v
-			}
-		}
-	}
-
-	if *polling < 0 {
-		*polling = 300
-	}
-
-	if *tempchange < 0 {
-		*tempchange = 12
-	}
+func createBridge(opts *bridgeOptions) *bridgeCfg {
+	setLogging(opts)
 
-	if *dnsCache {
+	if opts.DNSCache {
 		log.Debug().Msg("Use internal DNS cache")
 		net.DefaultResolver = DNS.NewCachingResolver(net.DefaultResolver)
 	}
 
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if *verbose {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	}
-
-	return &bridgeCfg{
-		Client:              MQTT.NewClient(createClientOptions(*broker, *user, *password, *clean, *topic)),
+	credentials.set(opts.User, opts.Password)
+	bridge := &bridgeCfg{
+		Client:              MQTT.NewClient(createClientOptions(opts.Broker, opts.Clean, opts.Topic)),
 		KeepRunning:         make(chan bool),
+		ReloadChannel:       make(chan bool, 1),
+		StatusChannel:       make(chan bool, 1),
+		Options:             opts,
 		WriteChannel:        make(chan writeEvent, 50),
 		RefreshRoomChannel:  make(chan string, 50),
-		HeatingURL:          *heating,
-		Polling:             *polling,
-		TempChange:          *tempchange,
-		Topic:               *topic,
-		Sensor:              *sensor,
-		FullInformation:     *full,
+		HeatingURL:          opts.Heating,
+		Polling:             opts.Polling,
+		TempChange:          opts.TempChange,
+		Debounce:            time.Duration(opts.Debounce) * time.Millisecond,
+		RateLimit:           time.Duration(opts.RateLimit) * time.Millisecond,
+		Topic:               opts.Topic,
+		Sensor:              opts.Sensor,
+		Discovery:           opts.Discovery,
+		RetainDiscovery:     opts.Retain,
+		DeviceDiscovery:     opts.DeviceDiscovery,
+		FullInformation:     opts.Full,
 		LastNumberOfDevices: -1,
 		SystemInformation:   make(map[string]string),
-	}
+		Rooms:               opts.Rooms,
+		RemoveGrace:         time.Duration(opts.RemoveGrace) * time.Minute,
+		VanishedRooms:       make(map[string]time.Time),
+		PublishedRooms:      make(map[string]bool),
+		HomieClient:         createHomieClient(opts),
+		HomieTopic:          homieBaseTopic(opts),
+		HomieVersion:        opts.HomieVersion,
+		HomieNodes:          make(map[string]homieNode),
+		Sinks:               createSinks(opts),
+		SinkChannel:         make(chan []point, 5),
+		StartTime:           time.Now(),
+		CleanDiscovery:      make(map[string]bool),
+	}
+	bridge.ReadOnly.Store(opts.ReadOnly)
+	return bridge
 }
 
 func setFields() {
@@ -721,6 +906,7 @@ func setFields() {
 		"hw.HostName", "hw.IP", "hw.NM", "hw.GW", "hw.Addr", "hw.DNS1", "hw.DNS2",
 
 		"R0.SystemStatus", "R0.DateTime",
+		"STM-APP", "STELL-APP",
 		"R0.kurzID", "R0.numberOfPairedDevices",
 		"R1.kurzID", "R1.numberOfPairedDevices",
 		"R2.kurzID", "R2.numberOfPairedDevices",
@@ -732,8 +918,7 @@ func setFields() {
 
 		"R0.uniqueID", "R1.uniqueID", "R2.uniqueID",
 
-		"STM-APP", "STM-BL",
-		"STELL-APP", "STELL-BL",
+		"STM-BL", "STELL-BL",
 		"VPI.href", "VPI.state",
 		"CD.uname", "CD.upass", "CD.ureg",
 	}
@@ -749,23 +934,50 @@ func setFields() {
 
 	roomFields = append(roomFields, roomFieldsTemperature...)
 
-	roomSetFields = []string{"name", "OPMode", "SollTemp", "TempSIUnit"}
+	roomSetFields = []string{"name", "OPMode", "SollTemp", "TempSIUnit", "SollTempMinVal", "SollTempMaxVal"}
 }
 
-func setLogger() {
-	zerolog.TimeFieldFormat = time.DateTime
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: zerolog.TimeFieldFormat})
+// roomStateFields returns every retained topic of a room.
+func roomStateFields() []string {
+	return append([]string{"OPMode_mode", "TempSIUnit_unit", "available", "battery", "RaumTempLastChange"}, roomFields...)
 }
 
 func main() {
 	setLogger()
-	bridge = createBridge()
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(healthcheck(os.Args[2:]))
+	}
+
+	opts, err := parseOptions(os.Args[1:])
+	if err != nil {
+		logConfigErrors(err)
+		log.Fatal().Msg("Invalid configuration")
+	}
+
+	if opts.CheckConfig {
+		log.Info().Msg("Configuration is valid")
+		return
+	}
+
+	bridge = createBridge(opts)
+	if err := startSession(opts); err != nil {
+		log.Fatal().Err(err).Msg("Cannot start controller session")
+	}
 	setupCloseHandler(bridge)
+	setupReloadHandler(bridge)
+	setupStatusHandler(bridge)
 
 	if token := bridge.Client.Connect(); token.Wait() && token.Error() != nil {
 		log.Fatal().Err(token.Error()).Msg("Cannot connect to broker")
 	} else {
+		if bridge.HomieClient != nil {
+			if token := bridge.HomieClient.Connect(); token.Wait() && token.Error() != nil {
+				log.Fatal().Err(token.Error()).Msg("Cannot connect Homie to broker")
+			}
+		}
+
 		setFields()
+		startHTTP(bridge, opts.HTTP)
 		go running(bridge)
 		<-bridge.KeepRunning
 	}
@@ -0,0 +1,192 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are provided in the text format of Prometheus, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type bridgeMetrics struct {
+	mutex         sync.Mutex
+	PollDuration  time.Duration
+	Polls         int
+	FetchErrors   int
+	Writes        map[bool]int
+	Connects      int
+	LastError     string
+	LastErrorTime time.Time
+}
+
+var metrics = &bridgeMetrics{
+	Writes: map[bool]int{},
+}
+
+// controllerLabels are the system fields provided as labels of heating_controller_info.
+var controllerLabels = map[string]string{
+	"host":      "hw.HostName",
+	"ip":        "hw.IP",
+	"mac":       "hw.Addr",
+	"stm_app":   "STM-APP",
+	"stell_app": "STELL-APP",
+}
+
+func (m *bridgeMetrics) addPoll(duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Polls++
+	m.PollDuration = duration
+}
+
+func (m *bridgeMetrics) addFetchError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.FetchErrors++
+	m.setError(err)
+}
+
+func (m *bridgeMetrics) addWrite(success bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Writes[success]++
+}
+
+func (m *bridgeMetrics) addConnect() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Connects++
+}
+
+func (m *bridgeMetrics) addError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.setError(err)
+}
+
+// setError must be called with locked mutex.
+func (m *bridgeMetrics) setError(err error) {
+	m.LastError = err.Error()
+	m.LastErrorTime = time.Now()
+}
+
+// snapshot returns a copy of the metrics.
+func (m *bridgeMetrics) snapshot() bridgeMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return bridgeMetrics{
+		PollDuration:  m.PollDuration,
+		Polls:         m.Polls,
+		FetchErrors:   m.FetchErrors,
+		Writes:        maps.Clone(m.Writes),
+		Connects:      m.Connects,
+		LastError:     m.LastError,
+		LastErrorTime: m.LastErrorTime,
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func boolMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind) //nolint:errcheck
+}
+
+func (m *bridgeMetrics) write(w io.Writer, bridge *bridgeCfg) {
+	roomStates := states.rooms()
+	system := states.system()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rooms := func(name string, kind string, help string, value func(room roomState) any) {
+		writeMetric(w, name, kind, help)
+		for _, room := range roomStates {
+			fmt.Fprintf(w, "%s{room=%q,name=\"%s\"} %v\n", name, room.ID, escapeLabel(room.Name), value(room)) //nolint:errcheck
+		}
+	}
+
+	rooms("heating_room_temperature", "gauge", "Current temperature of the room.",
+		func(room roomState) any { return room.Temperature })
+	rooms("heating_room_target_temperature", "gauge", "Target temperature of the room.",
+		func(room roomState) any { return room.TargetTemperature })
+	rooms("heating_room_mode", "gauge", "Heating mode of the room (0 day, 1 night, 2 holiday).",
+		func(room roomState) any { return room.Mode })
+	rooms("heating_room_last_temperature_change_seconds", "gauge", "Seconds since the last temperature change of the room.",
+		func(room roomState) any { return int(time.Since(room.LastTemperatureChange).Seconds()) })
+	rooms("heating_room_available", "gauge", "Whether the room has sent a temperature change in time.",
+		func(room roomState) any { return boolMetric(room.Available) })
+
+	writeMetric(w, "heating_controller_info", "gauge", "Information about the EnergyLogic.")
+	var labels []string
+	for _, label := range slices.Sorted(maps.Keys(controllerLabels)) {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", label, escapeLabel(system[controllerLabels[label]])))
+	}
+	fmt.Fprintf(w, "heating_controller_info{%s} 1\n", strings.Join(labels, ",")) //nolint:errcheck
+
+	writeMetric(w, "heating_bridge_info", "gauge", "Information about the bridge.")
+	fmt.Fprintf(w, "heating_bridge_info{version=\"%s\"} 1\n", escapeLabel(version)) //nolint:errcheck
+
+	writeMetric(w, "heating_bridge_poll_duration_seconds", "gauge", "Duration of the last poll of the EnergyLogic including every room.")
+	fmt.Fprintf(w, "heating_bridge_poll_duration_seconds %g\n", m.PollDuration.Seconds()) //nolint:errcheck
+
+	writeMetric(w, "heating_bridge_polls_total", "counter", "Number of polls of the EnergyLogic.")
+	fmt.Fprintf(w, "heating_bridge_polls_total %d\n", m.Polls) //nolint:errcheck
+
+	writeMetric(w, "heating_bridge_fetch_errors_total", "counter", "Number of failed reads from the EnergyLogic.")
+	fmt.Fprintf(w, "heating_bridge_fetch_errors_total %d\n", m.FetchErrors) //nolint:errcheck
+
+	writeMetric(w, "heating_bridge_writes_total", "counter", "Number of writes to the EnergyLogic by result.")
+	fmt.Fprintf(w, "heating_bridge_writes_total{result=\"success\"} %d\n", m.Writes[true])  //nolint:errcheck
+	fmt.Fprintf(w, "heating_bridge_writes_total{result=\"failure\"} %d\n", m.Writes[false]) //nolint:errcheck
+
+	writeMetric(w, "heating_bridge_write_queue_length", "gauge", "Number of queued writes.")
+	fmt.Fprintf(w, "heating_bridge_write_queue_length %d\n", len(bridge.WriteChannel)) //nolint:errcheck
+
+	writeMetric(w, "heating_bridge_refresh_queue_length", "gauge", "Number of queued refreshes.")
+	fmt.Fprintf(w, "heating_bridge_refresh_queue_length %d\n", len(bridge.RefreshRoomChannel)) //nolint:errcheck
+}
+
+func metricsHandler(bridge *bridgeCfg) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w, bridge)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A session records every request to the EnergyLogic with its response
+// as JSON lines. A recorded session can be replayed instead of the
+// EnergyLogic to reproduce a problem.
+
+type exchange struct {
+	Time     time.Time `json:"time"`
+	Request  string    `json:"request"` // path and query without host
+	Body     string    `json:"body,omitempty"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (e exchange) key() string {
+	return e.Request + "\n" + e.Body
+}
+
+type controllerSession struct {
+	mutex  sync.Mutex
+	Record *json.Encoder
+	Replay map[string][]exchange
+}
+
+var session = &controllerSession{}
+
+// startSession opens the file to record to or reads the session to replay.
+func startSession(opts *bridgeOptions) error {
+	if opts.Record != "" {
+		file, err := os.OpenFile(opts.Record, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		session.Record = json.NewEncoder(file)
+		session.Record.SetEscapeHTML(false) // keep XML readable
+		controllerLog.Info().Str("file", opts.Record).Msg("Record controller session")
+	}
+
+	if opts.Replay != "" {
+		replay, err := readSession(opts.Replay)
+		if err != nil {
+			return err
+		}
+		exchanges := 0
+		for _, recorded := range replay {
+			exchanges += len(recorded)
+		}
+		session.Replay = replay
+		controllerLog.Info().Str("file", opts.Replay).Int("requests", exchanges).Msg("Replay controller session")
+	}
+
+	return nil
+}
+
+// readSession returns the recorded exchanges in order of their request.
+func readSession(path string) (map[string][]exchange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	replay := make(map[string][]exchange)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var e exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		replay[e.key()] = append(replay[e.key()], e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(replay) == 0 {
+		return nil, fmt.Errorf("%s: no recorded request", path)
+	}
+
+	return replay, nil
+}
+
+func (s *controllerSession) record(e exchange) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Record == nil {
+		return
+	}
+
+	if err := s.Record.Encode(e); err != nil {
+		controllerLog.Error().Err(err).Msg("Cannot record request")
+	}
+}
+
+// replay returns the next recorded response of the request. The last
+// response is repeated after the recorded session is over.
+func (s *controllerSession) replay(e exchange) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recorded := s.Replay[e.key()]
+	if len(recorded) == 0 {
+		return "", fmt.Errorf("request %s is not recorded", e.Request)
+	}
+
+	next := recorded[0]
+	if len(recorded) > 1 {
+		s.Replay[e.key()] = recorded[1:]
+	}
+
+	controllerLog.Debug().Str("request", e.Request).Time("recorded", next.Time).Msg("Replay")
+	if next.Error != "" {
+		return "", errors.New(next.Error)
+	}
+	return next.Response, nil
+}
+
+// controllerRequest sends a request to the EnergyLogic and returns the body
+// of the response. It is a POST request if body is not empty.
+func controllerRequest(host string, request string, body string) (string, error) {
+	e := exchange{Time: time.Now(), Request: request, Body: body}
+	if session.Replay != nil {
+		return session.replay(e)
+	}
+
+	response, err := sendRequest(host, request, body)
+	e.Response = response
+	if err != nil {
+		e.Error = err.Error()
+	}
+	session.record(e)
+	return response, err
+}
+
+func sendRequest(host string, request string, body string) (string, error) {
+	url := "http://" + host + request
+
+	var resp *http.Response
+	var err error
+	if body == "" {
+		resp, err = http.Get(url)
+	} else {
+		resp, err = http.Post(url, "text/xml", strings.NewReader(body))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+	data, err := io.ReadAll(resp.Body)
+	return string(data), err
+}
@@ -0,0 +1,110 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A sink receives the values of every room on every poll, additionally
+// to MQTT. Time-series databases are added by implementing sink and
+// creating it in createSinks.
+type sink interface {
+	Name() string
+	Write(points []point) error
+}
+
+type point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]any // float64, int, bool or string
+	Time        time.Time
+}
+
+// createSinks returns every sink which is enabled by the options.
+func createSinks(opts *bridgeOptions) []sink {
+	var sinks []sink
+	if opts.Influx != "" {
+		sinks = append(sinks, newInfluxSink(opts))
+	}
+	return sinks
+}
+
+func roomPoint(host string, room roomState) point {
+	return point{
+		Measurement: "heating",
+		Tags: map[string]string{
+			"host": host,
+			"room": room.ID,
+			"name": room.Name,
+		},
+		Fields: map[string]any{
+			"temperature":        room.Temperature,
+			"target_temperature": room.TargetTemperature,
+			"mode":               room.Mode,
+			"available":          room.Available,
+		},
+		Time: time.Now(),
+	}
+}
+
+// collectPoint adds the state of a room to the points of the running poll.
+func collectPoint(bridge *bridgeCfg, number string) {
+	if len(bridge.Sinks) == 0 || !bridge.PollRooms[number] {
+		return
+	}
+
+	if room, found := states.room(number); found {
+		bridge.PollPoints = append(bridge.PollPoints, roomPoint(identifier(bridge), room))
+	}
+}
+
+// queuePoints hands the points of a poll to writeSinks. The points are
+// dropped if the queue is full, so a slow sink does not stall the polling.
+func queuePoints(bridge *bridgeCfg) {
+	points := bridge.PollPoints
+	bridge.PollPoints = nil
+	if len(points) == 0 {
+		return
+	}
+
+	select {
+	case bridge.SinkChannel <- points:
+	default:
+		log.Warn().Int("points", len(points)).Msg("Sink queue is full | Points are dropped")
+	}
+}
+
+// writeSinks writes the queued points to every sink.
+func writeSinks(bridge *bridgeCfg) {
+	for points := range bridge.SinkChannel {
+		for _, s := range bridge.Sinks {
+			if err := s.Write(points); err != nil {
+				log.Error().Err(err).Str("sink", s.Name()).Msg("Cannot write to sink")
+			}
+		}
+	}
+}
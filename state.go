@@ -0,0 +1,208 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The state keeps the last values of the EnergyLogic for the HTTP server,
+// as it is updated by the refresh goroutine and read by HTTP requests.
+// Every change is sent to the subscribers of the state.
+
+type roomState struct {
+	ID                    string            `json:"id"`
+	Name                  string            `json:"name"`
+	Temperature           float64           `json:"temperature"`
+	TargetTemperature     float64           `json:"target_temperature"`
+	MinTemperature        float64           `json:"min_temperature"`
+	MaxTemperature        float64           `json:"max_temperature"`
+	Unit                  string            `json:"unit"`
+	Mode                  int               `json:"mode"`
+	Available             bool              `json:"available"`
+	LastTemperatureChange time.Time         `json:"last_temperature_change"`
+	Values                map[string]string `json:"values"`
+}
+
+type stateEvent struct {
+	Type string
+	Data any
+}
+
+type jsonSnapshot struct {
+	Rooms  []roomState       `json:"rooms"`
+	System map[string]string `json:"system"`
+}
+
+type jsonRoomRemoved struct {
+	ID string `json:"id"`
+}
+
+type bridgeState struct {
+	mutex       sync.RWMutex
+	Rooms       map[string]roomState
+	System      map[string]string
+	Subscribers map[chan stateEvent]bool
+}
+
+var states = &bridgeState{
+	Rooms:       map[string]roomState{},
+	System:      map[string]string{},
+	Subscribers: map[chan stateEvent]bool{},
+}
+
+func parseFloat(value string) float64 {
+	v, _ := strconv.ParseFloat(value, 64)
+	return v
+}
+
+func (s *bridgeState) setRoom(number string, update func(room *roomState)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old := s.Rooms[number]
+	room := old
+	room.ID = number
+	room.Values = maps.Clone(old.Values)
+	update(&room)
+	s.Rooms[number] = room
+
+	if !reflect.DeepEqual(old, room) {
+		room.Values = maps.Clone(room.Values)
+		s.notify(stateEvent{"room", room})
+	}
+}
+
+func (s *bridgeState) setSystem(information map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !maps.Equal(s.System, information) {
+		s.System = maps.Clone(information)
+		s.notify(stateEvent{"system", maps.Clone(information)})
+	}
+}
+
+// subscribe returns a channel of every change, beginning with a snapshot
+// of the current state. The channel is closed by unsubscribe or if the
+// subscriber is too slow.
+func (s *bridgeState) subscribe() chan stateEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rooms := make([]roomState, 0, len(s.Rooms))
+	for _, number := range slices.SortedFunc(maps.Keys(s.Rooms), compareRooms) {
+		room := s.Rooms[number]
+		room.Values = maps.Clone(room.Values)
+		rooms = append(rooms, room)
+	}
+
+	events := make(chan stateEvent, 32)
+	events <- stateEvent{"snapshot", jsonSnapshot{Rooms: rooms, System: maps.Clone(s.System)}}
+	s.Subscribers[events] = true
+	return events
+}
+
+func (s *bridgeState) unsubscribe(events chan stateEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Subscribers[events] {
+		delete(s.Subscribers, events)
+		close(events)
+	}
+}
+
+// notify must be called with locked mutex.
+func (s *bridgeState) notify(event stateEvent) {
+	for events := range s.Subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Warn().Msg("Drop slow subscriber of state")
+			delete(s.Subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// room returns a copy of the state of a room.
+func (s *bridgeState) room(number string) (roomState, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	room, found := s.Rooms[number]
+	room.Values = maps.Clone(room.Values)
+	return room, found
+}
+
+// rooms returns a copy of the state of every room ordered by number.
+func (s *bridgeState) rooms() []roomState {
+	s.mutex.RLock()
+	numbers := slices.SortedFunc(maps.Keys(s.Rooms), compareRooms)
+	s.mutex.RUnlock()
+
+	rooms := make([]roomState, 0, len(numbers))
+	for _, number := range numbers {
+		if room, found := s.room(number); found {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+func (s *bridgeState) system() map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return maps.Clone(s.System)
+}
+
+// roomIndex returns the number of a room like G0, or -1 if it is invalid.
+func roomIndex(number string) int {
+	index, err := strconv.Atoi(strings.TrimPrefix(number, "G"))
+	if err != nil || !strings.HasPrefix(number, "G") {
+		return -1
+	}
+	return index
+}
+
+func compareRooms(a string, b string) int {
+	return roomIndex(a) - roomIndex(b)
+}
+
+// removeRoomStates removes the state of vanished and excluded rooms.
+func removeRoomStates(bridge *bridgeCfg, totalNumberOfDevices int) {
+	states.mutex.Lock()
+	defer states.mutex.Unlock()
+	for number := range states.Rooms {
+		if roomIndex(number) >= totalNumberOfDevices || bridge.Rooms[number].Exclude {
+			delete(states.Rooms, number)
+			states.notify(stateEvent{"remove", jsonRoomRemoved{ID: number}})
+		}
+	}
+}
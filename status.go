@@ -0,0 +1,88 @@
+/*
+	Copyright (c) 2021 A. Klitzing <aklitzing@gmail.com>
+
+	Permission is hereby granted, free of charge, to any person obtaining
+	a copy of this software and associated documentation files (the
+	"Software"), to deal in the Software without restriction, including
+	without limitation the rights to use, copy, modify, merge, publish,
+	distribute, sublicense, and/or sell copies of the Software, and to
+	permit persons to whom the Software is furnished to do so, subject to
+	the following conditions:
+
+	The above copyright notice and this permission notice shall be
+	included in all copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+	EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+	MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+	NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+	LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+	OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+	WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type jsonBridgeStatus struct {
+	Version            string     `json:"version"`
+	StartTime          time.Time  `json:"start_time"`
+	UptimeSeconds      int        `json:"uptime_seconds"`
+	PollingSeconds     int        `json:"polling_seconds"`
+	LastPollDurationMs int64      `json:"last_poll_duration_ms"`
+	LastPollResult     string     `json:"last_poll_result"`
+	Polls              int        `json:"polls"`
+	FetchErrors        int        `json:"fetch_errors"`
+	WriteErrors        int        `json:"write_errors"`
+	Rooms              int        `json:"rooms"`
+	MqttReconnects     int        `json:"mqtt_reconnects"`
+	LastError          string     `json:"last_error,omitempty"`
+	LastErrorTime      *time.Time `json:"last_error_time,omitempty"`
+}
+
+// publishStatus publishes the diagnostics of the bridge to <topic>/bridge/status.
+// It must be called by the refresh goroutine.
+func publishStatus(bridge *bridgeCfg) {
+	m := metrics.snapshot()
+	status := jsonBridgeStatus{
+		Version:            version,
+		StartTime:          bridge.StartTime,
+		UptimeSeconds:      int(time.Since(bridge.StartTime).Seconds()),
+		PollingSeconds:     bridge.Polling,
+		LastPollDurationMs: m.PollDuration.Milliseconds(),
+		LastPollResult:     "ok",
+		Polls:              m.Polls,
+		FetchErrors:        m.FetchErrors,
+		WriteErrors:        m.Writes[false],
+		MqttReconnects:     max(m.Connects-1, 0),
+		LastError:          m.LastError,
+	}
+
+	for i := 0; i < bridge.LastNumberOfDevices; i++ {
+		if !bridge.Rooms[fmt.Sprint("G", i)].Exclude {
+			status.Rooms++
+		}
+	}
+
+	if report := health.report(bridge); report.ControllerError != "" {
+		status.LastPollResult = report.ControllerError
+	}
+
+	if !m.LastErrorTime.IsZero() {
+		status.LastErrorTime = &m.LastErrorTime
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot marshal status")
+		return
+	}
+	publish(bridge, bridge.Topic+"/bridge/status", string(data), true)
+}